@@ -12,9 +12,7 @@ package main
 import (
 	"bytes"
 	"flag"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"net/smtp"
 	"regexp"
 	"strconv"
@@ -23,6 +21,7 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/fsouza/inv_bots/lib"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"launchpad.net/xmlpath"
@@ -54,10 +53,16 @@ var (
 	pathLink      = xmlpath.MustCompile("./td[3]/a")
 	pathLinkHref  = xmlpath.MustCompile("./td[3]/a/@href")
 	regexpLink    = regexp.MustCompile(`Javascript:AbreArquivo\('(\d+)'\)`)
-	sender        string
-	password      string
-	recipient     string
-	tickerTime    time.Duration
+	sanitizers    = []lib.Sanitizer{
+		lib.Replace("HTML", "html"),
+		lib.Replace("<<", ""),
+		lib.Replace(">>", ""),
+	}
+	fetcher    = lib.NewFetcher()
+	sender     string
+	password   string
+	recipient  string
+	tickerTime time.Duration
 )
 
 func init() {
@@ -79,38 +84,24 @@ func connect() (*mgo.Session, error) {
 	return mgo.Dial("localhost:27017")
 }
 
-func toUTF8(input []byte) string {
-	result := make([]rune, len(input))
-	for i, b := range input {
-		result[i] = rune(b)
-	}
-	return string(result)
+// recordsScraper collects the records in the listing of material facts. It
+// keeps going to the next page while the last record in the page is from
+// today.
+type recordsScraper struct {
+	today   string
+	records []Record
 }
 
-func pageRecords(page int) []Record {
-	today := time.Now().Format("02/01/2006")
-	url := listURL + strconv.Itoa(page)
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return nil
-	}
-	defer resp.Body.Close()
+func (s *recordsScraper) URL(page int) string {
+	return listURL + strconv.Itoa(page)
+}
+
+func (s *recordsScraper) Sanitizers() []lib.Sanitizer {
+	return sanitizers
+}
+
+func (s *recordsScraper) Scrape(page int, root *xmlpath.Node) (bool, error) {
 	records := make([]Record, 0, 6)
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return nil
-	}
-	strBody := strings.Replace(toUTF8(body), "HTML", "html", -1)
-	strBody = strings.Replace(strBody, "<<", "", -1)
-	strBody = strings.Replace(strBody, ">>", "", -1)
-	reader := strings.NewReader(strBody)
-	root, err := xmlpath.ParseHTML(reader)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return nil
-	}
 	trs := pathTR.Iter(root)
 	trs.Next()
 	for trs.Next() {
@@ -149,17 +140,17 @@ func pageRecords(page int) []Record {
 		}
 		records = append(records, record)
 	}
-	if length := len(records); length > 0 && records[length-1].ReferenceDate == today {
-		nextPageRecords := pageRecords(page + 1)
-		for _, record := range nextPageRecords {
-			records = append(records, record)
-		}
-	}
-	return records
+	s.records = append(s.records, records...)
+	length := len(records)
+	return length > 0 && records[length-1].ReferenceDate == s.today, nil
 }
 
 func getRecords() []Record {
-	pageRecords := pageRecords(1)
+	scraper := recordsScraper{today: time.Now().Format("02/01/2006")}
+	if err := fetcher.Scrape(&scraper); err != nil {
+		log.Printf("ERROR: %s", err)
+	}
+	pageRecords := scraper.records
 	if len(pageRecords) < 1 {
 		return nil
 	}
@@ -2,44 +2,220 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// This services serves two feeds using news from "Plantão Empresas". One of
-// the feeds is exclusive for FIIs and the other for all other news, excluding
-// news related to FIIs.
+// This services serves feeds using news from "Plantão Empresas". By default
+// there are two feeds: one of them is exclusive for FIIs and the other for all
+// other news, excluding news related to FIIs.
+//
+// Feeds may also be defined in a JSON config file, provided via the -config
+// flag, and each feed is served at /{name}.atom, /{name}.rss and /{name}.json
+// (JSON Feed). When the extension is omitted, the format is negotiated using
+// the Accept header. Sending SIGHUP to the process reloads the config file.
+// Besides the feeds, the config file also defines the metadata shared by all
+// feeds. Example:
+//
+//	{
+//		"title": "Bovespa - Plantão Empresas",
+//		"description": "Notícias sobre empresas listadas na Bovespa",
+//		"author": {"name": "Francisco Souza", "email": "f@souza.cc"},
+//		"created": "2014-03-20T10:00:00-03:00",
+//		"feeds": [
+//			{"name": "fii", "include": ["^fii"]},
+//			{"name": "bancos", "title": "Bancos", "tickers": ["BBAS3", "ITUB4"], "limit": 50},
+//			{"name": "dividendos", "categories": ["dividend"], "exclude": ["^fii"]}
+//		]
+//	}
+//
+// The regular expressions in include and exclude are matched, ignoring case,
+// against the title of the news by MongoDB, which uses PCRE, but they're
+// validated with Go's regexp package (RE2) when the config is loaded. Only the
+// syntax common to both is supported: lookarounds (like "^((?!fii))") and
+// backreferences are rejected (use exclude instead of negative lookaheads),
+// and constructs that the dialects read differently are accepted, but behave
+// as in PCRE (for example, $ also matches before a trailing newline).
+//
+// Every click in a news goes through the service, which records it. The most
+// clicked news per day and per feed are available in /stats. Clicks in the
+// HTML interface are attributed to "web", which is not a valid feed name.
+//
+// Ad-hoc feeds are served at /search.{atom,rss,json}, using the parameters q
+// (text to search in the title and body of the news), ticker and category
+// (both may be repeated), since (a date, in the format YYYY-MM-DD) and limit (capped at
+// MaxLimit).
+//
+// The same news can also be browsed in HTML, at /.
+//
+// News corrected by the exchange (see plantao_empresas.go) are flagged in the
+// feeds, and the revision history of each news is served in JSON format at
+// /bovespa/{id}/revisions. The latest revisions of all news are served at
+// /revisions (limit defaults to 50 and is capped at MaxLimit).
+//
+// The service is also a WebSub hub, available at /hub and advertised in the
+// Link header of every feed. Subscribers receive the updated feed whenever
+// plantao_empresas publishes new news, sending a request with hub.mode=publish
+// to the hub, authenticated by the X-Hub-Publish-Secret header (see the
+// -publish-secret flag). Topics must be feeds in the host of the service, as
+// seen in the subscription request (see below).
+//
+// Links in the feeds are absolute, and built using the -base-url flag. When
+// it's not provided, the service uses the host of the request, or the headers
+// X-Forwarded-Proto and X-Forwarded-Host, for requests coming from one of the
+// proxies listed in the -trusted-proxies flag.
+//
+// The service starts even when MongoDB is not available, retrying the
+// connection in background. Until it's connected, every request is answered
+// with 503 (Service Unavailable).
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/fsouza/inv_bots/lib"
 	"github.com/gorilla/feeds"
-	"github.com/tsuru/tsuru/db/storage"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 const (
-	NewsURL = "http://www.bmfbovespa.com.br/agencia/corpo.asp?origem=exibir&id=%s"
-	Limit   = 100
+	NewsURL  = "http://www.bmfbovespa.com.br/agencia/corpo.asp?origem=exibir&id=%s"
+	Limit    = 100
+	MaxLimit = 500
+
+	// maxCachedFeeds is the maximum number of rendered feeds kept in memory.
+	// Ad-hoc feeds make the number of combinations unbounded, so the cache is
+	// flushed whenever it gets full.
+	maxCachedFeeds = 1000
+
+	// statsLimit is the number of news listed for each day and feed in the
+	// stats.
+	statsLimit = 10
+
+	// pageSize is the number of news displayed in each page of the HTML
+	// interface.
+	pageSize = 50
 )
 
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="pt-br">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<ul>
+{{range .Feeds}}<li>{{if eq . $.Feed}}<strong>{{.}}</strong>{{else}}<a href="/?feed={{.}}">{{.}}</a>{{end}}</li>
+{{end}}</ul>
+<form method="get" action="/">
+<input type="hidden" name="feed" value="{{.Feed}}">
+<input type="search" name="q" value="{{.Query}}" placeholder="Buscar">
+de <input type="date" name="from" value="{{.From}}">
+até <input type="date" name="to" value="{{.To}}">
+<button type="submit">Buscar</button>
+</form>
+<table>
+{{range .News}}<tr><td>{{.Date.Format "02/01/2006 15:04"}}</td><td><a href="{{.FeedPath "web"}}">{{.FeedTitle}}</a></td></tr>
+{{else}}<tr><td>Nenhuma notícia encontrada.</td></tr>
+{{end}}</table>
+<p>
+{{if .Previous}}<a href="{{.Previous}}">&laquo; Anteriores</a>{{end}}
+{{if .Next}}<a href="{{.Next}}">Próximas &raquo;</a>{{end}}
+</p>
+</body>
+</html>`))
+
 var (
-	listenHTTP string
-	regexpNews = regexp.MustCompile(`^/bovespa/(\d+)$`)
+	listenHTTP      string
+	configFile      string
+	publicURL       string
+	publishSecret   string
+	webHub          *lib.Hub
+	trustedProxies  []*net.IPNet
+	mongoURI        string
+	session         *mgo.Session
+	sessionMutex    sync.RWMutex
+	regexpNews      = regexp.MustCompile(`^/bovespa/(\d+)$`)
+	regexpRevisions = regexp.MustCompile(`^/bovespa/(\d+)/revisions$`)
+	regexpFeed      = regexp.MustCompile(`^/([a-z0-9_-]+)(?:\.(atom|rss|json))?$`)
+	regexpFeedName  = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	reservedNames   = map[string]bool{"search": true, "health": true, "stats": true, "hub": true, "revisions": true, "web": true}
+	regexpParagraph = regexp.MustCompile(`\n\s*\n`)
+	defaultFeeds    = []FeedConfig{
+		{Name: "all", Exclude: []string{"^fii"}},
+		{Name: "fii", Include: []string{"^fii"}},
+	}
+	defaultMetadata = Metadata{
+		Title:       "Bovespa - Plantão Empresas",
+		Description: "Notícias sobre empresas listadas na Bovespa",
+		Author:      Author{Name: "Francisco Souza", Email: "f@souza.cc"},
+		Created:     time.Date(2014, 3, 20, 13, 0, 0, 0, time.UTC),
+	}
+	registry    feedRegistry
+	cache       feedCache
+	feedFormats = map[string]feedFormat{
+		"atom": {contentType: "application/atom+xml", render: (*feeds.Feed).ToAtom},
+		"rss":  {contentType: "application/rss+xml", render: (*feeds.Feed).ToRss},
+		"json": {contentType: "application/feed+json", render: (*feeds.Feed).ToJSON},
+	}
+	mediaTypes = map[string]string{
+		"application/atom+xml":  "atom",
+		"application/rss+xml":   "rss",
+		"application/feed+json": "json",
+		"application/json":      "json",
+	}
 )
 
 func init() {
 	flag.StringVar(&listenHTTP, "listen", "127.0.0.1:7676", "address to listen to connections")
+	flag.StringVar(&configFile, "config", "", "JSON file with the definition of the feeds")
+	flag.StringVar(&publicURL, "base-url", "", "public URL of the service, used in links (default: based on the request)")
+	flag.Var(proxyList{&trustedProxies}, "trusted-proxies", "comma-separated list of IPs or CIDRs of proxies trusted to set X-Forwarded-* headers")
+	flag.StringVar(&publishSecret, "publish-secret", "", "secret required for publishing to the hub (publishing is disabled when empty)")
+	flag.StringVar(&mongoURI, "mongodb", "localhost:27017/bovespa_plantao_empresas", "MongoDB connection string, including the database")
 	flag.Parse()
 }
 
 type News struct {
-	ID    string `bson:"_id"`
-	Title string
-	Date  time.Time
+	ID       string `bson:"_id"`
+	Title    string
+	Date     time.Time
+	Body     string `bson:",omitempty"`
+	Issuer   string
+	Tickers  []string
+	Category string
+	Removed  bool      `bson:",omitempty"`
+	Revised  time.Time `bson:",omitempty"`
+	Modified time.Time `bson:",omitempty"`
+}
+
+// Revision is a change in a news, recorded by plantao_empresas.
+type Revision struct {
+	NewsID        string
+	Kind          string
+	Title         string
+	Date          time.Time
+	PreviousTitle string     `json:",omitempty"`
+	PreviousDate  *time.Time `json:",omitempty"`
+	Found         time.Time
 }
 
 func (n *News) RedirectURL() string {
@@ -50,29 +226,592 @@ func (n *News) Path() string {
 	return "/bovespa/" + n.ID
 }
 
-func collection() (*storage.Collection, error) {
-	storage, err := storage.Open("localhost:27017", "bovespa_plantao_empresas")
+// FeedPath returns the path of the news when linked from the given feed, so
+// clicks can be attributed to the feed.
+func (n *News) FeedPath(feed string) string {
+	return n.Path() + "?feed=" + url.QueryEscape(feed)
+}
+
+// FeedTitle returns the title of the news as displayed in feeds, flagging
+// news that were corrected or removed.
+func (n *News) FeedTitle() string {
+	switch {
+	case n.Removed:
+		return "[Removida] " + n.Title
+	case !n.Revised.IsZero():
+		return "[Corrigida] " + n.Title
+	}
+	return n.Title
+}
+
+// Updated returns the time of the latest change in the news.
+func (n *News) Updated() time.Time {
+	if n.Revised.After(n.Date) {
+		return n.Revised
+	}
+	return n.Date
+}
+
+// LastModified returns the time of the latest write to the news, including
+// changes that aren't revisions, like the download of the body.
+func (n *News) LastModified() time.Time {
+	if n.Modified.After(n.Updated()) {
+		return n.Modified
+	}
+	return n.Updated()
+}
+
+// Content returns the body of the news as HTML. The body is stored as plain
+// text, so it's escaped and each block of text becomes a paragraph.
+func (n *News) Content() string {
+	var content bytes.Buffer
+	for _, paragraph := range regexpParagraph.Split(strings.TrimSpace(n.Body), -1) {
+		if paragraph = strings.TrimSpace(paragraph); paragraph == "" {
+			continue
+		}
+		paragraph = html.EscapeString(paragraph)
+		paragraph = strings.Replace(paragraph, "\n", "<br>", -1)
+		fmt.Fprintf(&content, "<p>%s</p>\n", paragraph)
+	}
+	return content.String()
+}
+
+type feedFormat struct {
+	contentType string
+	render      func(*feeds.Feed) (string, error)
+}
+
+// negotiateFormat returns the name of the format that best matches the
+// Accept header of the request, defaulting to Atom.
+func negotiateFormat(r *http.Request) string {
+	format, quality := "atom", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		name, ok := mediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q > quality {
+			format, quality = name, q
+		}
+	}
+	return format
+}
+
+// Click represents a request to redirectNews.
+type Click struct {
+	NewsID    string
+	Feed      string `bson:",omitempty"`
+	UserAgent string `bson:",omitempty"`
+	Date      time.Time
+	Day       string
+}
+
+// NewsClicks is the number of clicks in a news, used in the stats.
+type NewsClicks struct {
+	ID     string
+	Title  string
+	Clicks int
+}
+
+// Config is the content of the config file.
+type Config struct {
+	Metadata
+	Feeds []FeedConfig
+}
+
+// Metadata contains information shared by all feeds. Title is also used as
+// the prefix of the title of feeds that don't define one.
+type Metadata struct {
+	Title       string
+	Description string
+	Author      Author
+	Created     time.Time
+}
+
+type Author struct {
+	Name  string
+	Email string
+}
+
+// proxyList is a flag.Value for the list of trusted proxies.
+type proxyList struct {
+	nets *[]*net.IPNet
+}
+
+func (l proxyList) String() string {
+	if l.nets == nil {
+		return ""
+	}
+	values := make([]string, len(*l.nets))
+	for i, n := range *l.nets {
+		values[i] = n.String()
+	}
+	return strings.Join(values, ",")
+}
+
+func (l proxyList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		*l.nets = append(*l.nets, n)
+	}
+	return nil
+}
+
+// requestBaseURL returns the public URL of the service, without the trailing slash.
+func requestBaseURL(r *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if trustedProxy(r) {
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := firstHeaderValue(r, "X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+func firstHeaderValue(r *http.Request, header string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(header), ",")[0])
+}
+
+func trustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FeedConfig defines a feed, served at /{Name}.atom, /{Name}.rss and
+// /{Name}.json.
+//
+// A news is included in the feed if its title matches at least one of the
+// Include regular expressions (when there are any), none of the Exclude
+// regular expressions, mentions at least one of the tickers (when there are
+// any) and belongs to one of the categories (when there are any). Categories
+// are assigned by plantao_empresas.
+type FeedConfig struct {
+	Name       string
+	Title      string
+	Include    []string
+	Exclude    []string
+	Tickers    []string
+	Categories []string
+	Limit      int
+	since      time.Time
+	until      time.Time
+	text       string
+}
+
+// validate checks the config. Regular expressions are checked with RE2, which
+// rejects PCRE-only syntax, but not RE2-only syntax (see the package
+// documentation).
+func (c *FeedConfig) validate() error {
+	if !regexpFeedName.MatchString(c.Name) || reservedNames[c.Name] {
+		return fmt.Errorf("invalid feed name: %q", c.Name)
+	}
+	for _, expr := range append(c.Include, c.Exclude...) {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid regular expression in feed %q: %s", c.Name, err)
+		}
+	}
+	if c.Limit < 0 {
+		return fmt.Errorf("invalid limit in feed %q: %d", c.Name, c.Limit)
+	}
+	return nil
+}
+
+func (c *FeedConfig) query() bson.M {
+	var conditions []bson.M
+	if len(c.Include) > 0 {
+		include := make([]bson.M, len(c.Include))
+		for i, expr := range c.Include {
+			include[i] = bson.M{"title": bson.RegEx{Pattern: expr, Options: "i"}}
+		}
+		conditions = append(conditions, bson.M{"$or": include})
+	}
+	for _, expr := range c.Exclude {
+		conditions = append(conditions, bson.M{"title": bson.M{"$not": bson.RegEx{Pattern: expr, Options: "i"}}})
+	}
+	if len(c.Tickers) > 0 {
+		// News that mention only the root of the ticker (e.g. PETR instead
+		// of PETR4) are also included.
+		tickers := make([]string, 0, 2*len(c.Tickers))
+		for _, ticker := range c.Tickers {
+			ticker = strings.ToUpper(ticker)
+			tickers = append(tickers, ticker)
+			if len(ticker) > 4 {
+				tickers = append(tickers, ticker[:4])
+			}
+		}
+		conditions = append(conditions, bson.M{"tickers": bson.M{"$in": tickers}})
+	}
+	if len(c.Categories) > 0 {
+		conditions = append(conditions, bson.M{"category": bson.M{"$in": c.Categories}})
+	}
+	if c.text != "" {
+		pattern := regexp.QuoteMeta(c.text)
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{"title": bson.RegEx{Pattern: pattern, Options: "i"}},
+			{"body": bson.RegEx{Pattern: pattern, Options: "i"}},
+		}})
+	}
+	if !c.since.IsZero() {
+		conditions = append(conditions, bson.M{"date": bson.M{"$gte": c.since}})
+	}
+	if !c.until.IsZero() {
+		conditions = append(conditions, bson.M{"date": bson.M{"$lt": c.until}})
+	}
+	if len(conditions) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conditions}
+}
+
+func (c *FeedConfig) limit() int {
+	if c.Limit > MaxLimit {
+		return MaxLimit
+	}
+	if c.Limit > 0 {
+		return c.Limit
+	}
+	return Limit
+}
+
+func (c *FeedConfig) title(metadata *Metadata) string {
+	if c.Title != "" {
+		return c.Title
+	}
+	return metadata.Title + " - " + c.Name
+}
+
+// feedRegistry holds the feeds currently being served. It's safe for
+// concurrent use, so feeds can be replaced while requests are being handled.
+type feedRegistry struct {
+	feeds    map[string]FeedConfig
+	metadata Metadata
+	mutex    sync.RWMutex
+}
+
+func (r *feedRegistry) getMetadata() Metadata {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.metadata
+}
+
+func (r *feedRegistry) get(name string) (FeedConfig, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	feed, ok := r.feeds[name]
+	return feed, ok
+}
+
+func (r *feedRegistry) names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	names := make([]string, 0, len(r.feeds))
+	for name := range r.feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *feedRegistry) set(config *Config) error {
+	m := make(map[string]FeedConfig, len(config.Feeds))
+	for _, feed := range config.Feeds {
+		if err := feed.validate(); err != nil {
+			return err
+		}
+		if _, ok := m[feed.Name]; ok {
+			return fmt.Errorf("duplicate feed: %q", feed.Name)
+		}
+		m[feed.Name] = feed
+	}
+	r.mutex.Lock()
+	r.feeds = m
+	r.metadata = config.Metadata
+	r.mutex.Unlock()
+	return nil
+}
+
+type cachedFeed struct {
+	etag    string
+	content string
+}
+
+// feedCache keeps rendered feeds in memory. Entries are identified by the
+// feed definition, format and base URL, and are valid for as long as the
+// newest news in the feed remains the same.
+type feedCache struct {
+	entries map[string]cachedFeed
+	mutex   sync.Mutex
+}
+
+func (c *feedCache) get(key, etag string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || entry.etag != etag {
+		return "", false
+	}
+	return entry.content, true
+}
+
+func (c *feedCache) set(key, etag, content string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil || len(c.entries) >= maxCachedFeeds {
+		c.entries = make(map[string]cachedFeed)
+	}
+	c.entries[key] = cachedFeed{etag: etag, content: content}
+}
+
+func cacheKey(config FeedConfig, metadata Metadata, format, baseURL string) string {
+	return fmt.Sprintf("%s|%s|%#v|%#v", format, baseURL, config, metadata)
+}
+
+func feedETag(key string, latest *feedVersion) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s|%s|%d|%d", key, latest.ID, latest.Date.UnixNano(), latest.Modified.UnixNano())
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil))
+}
+
+// notModified checks the conditional headers of the request. If-None-Match
+// takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, value := range strings.Split(match, ",") {
+			value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+			if value == etag || value == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// loadConfig reads the config file. Metadata omitted in the file is filled
+// with the default values.
+func loadConfig(filename string) (*Config, error) {
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	coll := storage.Collection("news")
-	coll.EnsureIndex(mgo.Index{Key: []string{"title"}, Background: true, Sparse: true})
-	coll.EnsureIndex(mgo.Index{Key: []string{"-date"}, Background: true, Sparse: true})
-	coll.EnsureIndex(mgo.Index{Key: []string{"title", "-date"}, Background: true, Sparse: true})
-	return coll, nil
+	defer file.Close()
+	var config Config
+	err = json.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Feeds) == 0 {
+		return nil, errors.New("no feeds defined in the config file")
+	}
+	if config.Title == "" {
+		config.Title = defaultMetadata.Title
+	}
+	if config.Description == "" {
+		config.Description = defaultMetadata.Description
+	}
+	if config.Author.Name == "" && config.Author.Email == "" {
+		config.Author = defaultMetadata.Author
+	}
+	if config.Created.IsZero() {
+		config.Created = defaultMetadata.Created
+	}
+	return &config, nil
 }
 
-func getFeed(query bson.M, id string, baseURL string) (*feeds.Feed, error) {
-	if strings.HasSuffix(baseURL, "/") {
-		baseURL = baseURL[:len(baseURL)-1]
+func loadFeeds() error {
+	if configFile == "" {
+		return registry.set(&Config{Metadata: defaultMetadata, Feeds: defaultFeeds})
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	return registry.set(config)
+}
+
+func reloadOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for _ = range sigs {
+		if err := loadFeeds(); err != nil {
+			log.Printf("[ERROR] Failed to reload feeds, keeping the previous ones: %s", err)
+			continue
+		}
+		log.Print("[INFO] Feeds reloaded")
+	}
+}
+
+// connect opens the session used by the whole service and makes sure the
+// indexes exist. Handlers must use collection, which copies the session.
+func connect() error {
+	s, err := mgo.DialWithTimeout(mongoURI, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if err = ensureIndexes(s); err != nil {
+		s.Close()
+		return err
+	}
+	sessionMutex.Lock()
+	session = s
+	sessionMutex.Unlock()
+	return nil
+}
+
+// connectLoop calls connect until it succeeds.
+func connectLoop() {
+	for {
+		err := connect()
+		if err == nil {
+			log.Print("[INFO] Connected to MongoDB")
+			return
+		}
+		log.Printf("[ERROR] Failed to connect to MongoDB: %s", err)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// mainSession returns the session opened by connect, or nil when the service
+// is not connected yet.
+func mainSession() *mgo.Session {
+	sessionMutex.RLock()
+	defer sessionMutex.RUnlock()
+	return session
+}
+
+// available wraps handlers that depend on MongoDB, answering with 503 until
+// the service is connected.
+func available(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mainSession() == nil {
+			http.Error(w, "MongoDB: not connected", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ensureIndexes creates the indexes used by the service.
+func ensureIndexes(s *mgo.Session) error {
+	var err error
+	coll := s.DB("").C("news")
+	indexes := []mgo.Index{
+		{Key: []string{"title"}, Background: true, Sparse: true},
+		{Key: []string{"-date"}, Background: true, Sparse: true},
+		{Key: []string{"title", "-date"}, Background: true, Sparse: true},
+		{Key: []string{"category", "-date"}, Background: true, Sparse: true},
+		{Key: []string{"tickers", "-date"}, Background: true, Sparse: true},
+		{Key: []string{"-modified"}, Background: true, Sparse: true},
+	}
+	for _, index := range indexes {
+		if err = coll.EnsureIndex(index); err != nil {
+			return err
+		}
 	}
-	coll, err := collection()
+	err = s.DB("").C("clicks").EnsureIndex(mgo.Index{Key: []string{"-date"}, Background: true})
 	if err != nil {
+		return err
+	}
+	err = s.DB("").C("revisions").EnsureIndex(mgo.Index{Key: []string{"newsid", "-found"}, Background: true})
+	if err != nil {
+		return err
+	}
+	err = s.DB("").C("revisions").EnsureIndex(mgo.Index{Key: []string{"-found"}, Background: true})
+	if err != nil {
+		return err
+	}
+	return s.DB("").C("subscriptions").EnsureIndex(mgo.Index{Key: []string{"callback", "topic"}, Unique: true})
+}
+
+// collection returns the news collection in a copy of the main session. The
+// caller is responsible for closing the session.
+func collection() *mgo.Collection {
+	return mainSession().Copy().DB("").C("news")
+}
+
+// feedVersion identifies the current version of a feed: its newest news, with
+// Modified holding the latest write to any news. Writes to news outside of the
+// feed also change the version, but looking at all news is a single lookup in
+// the index, and it also catches news that left the feed (e.g. because their
+// category changed).
+type feedVersion struct {
+	News
+}
+
+// latestNews returns the version of the feed. The ID and Date are empty when
+// the feed is empty.
+func latestNews(config FeedConfig) (*feedVersion, error) {
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var latest feedVersion
+	var modified News
+	err := coll.Find(config.query()).Select(bson.M{"date": 1}).Sort("-date").One(&latest.News)
+	if err != nil && err != mgo.ErrNotFound {
 		return nil, err
 	}
-	defer coll.Close()
+	err = coll.Find(bson.M{"modified": bson.M{"$exists": true}}).Select(bson.M{"modified": 1}).Sort("-modified").One(&modified)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	latest.Modified = modified.Modified
+	return &latest, nil
+}
+
+func getFeed(config FeedConfig, metadata Metadata, baseURL string) (*feeds.Feed, error) {
+	if strings.HasSuffix(baseURL, "/") {
+		baseURL = baseURL[:len(baseURL)-1]
+	}
+	coll := collection()
+	defer coll.Database.Session.Close()
 	var newsList []News
-	err = coll.Find(query).Sort("-date").Limit(Limit).All(&newsList)
+	err := coll.Find(config.query()).Sort("-date").Limit(config.limit()).All(&newsList)
 	if err != nil {
 		return nil, err
 	}
@@ -81,61 +820,190 @@ func getFeed(query bson.M, id string, baseURL string) (*feeds.Feed, error) {
 	if len(newsList) > 0 {
 		updated = newsList[0].Date.In(location)
 	}
+	for _, news := range newsList {
+		if news.Revised.After(updated) {
+			updated = news.Revised.In(location)
+		}
+	}
 	feed := &feeds.Feed{
-		Title:       "Bovespa - Plantão Empresas - " + id,
-		Link:        &feeds.Link{Href: baseURL + "?w=" + id},
-		Description: "Notícias sobre empresas listadas na Bovespa",
-		Author:      &feeds.Author{Name: "Francisco Souza", Email: "f@souza.cc"},
-		Created:     time.Date(2014, 3, 20, 10, 0, 0, 0, location),
+		Title:       config.title(&metadata),
+		Link:        &feeds.Link{Href: baseURL + "?w=" + config.Name},
+		Description: metadata.Description,
+		Author:      &feeds.Author{Name: metadata.Author.Name, Email: metadata.Author.Email},
+		Created:     metadata.Created.In(location),
 		Updated:     updated,
 	}
 	for _, news := range newsList {
 		item := feeds.Item{
 			Id:          baseURL + news.Path(),
-			Title:       news.Title,
-			Link:        &feeds.Link{Href: baseURL + news.Path()},
+			Title:       news.FeedTitle(),
+			Link:        &feeds.Link{Href: baseURL + news.FeedPath(config.Name)},
 			Description: news.Title,
+			Content:     news.Content(),
 			Author:      &feeds.Author{Name: "Bovespa", Email: "bovespa@bmfbovespa.com.br"},
 			Created:     news.Date,
-			Updated:     news.Date,
+			Updated:     news.Updated(),
 		}
 		feed.Items = append(feed.Items, &item)
 	}
 	return feed, nil
 }
 
-func feedAll(w http.ResponseWriter, r *http.Request) {
-	baseURL := "http://" + r.Host
-	feed, err := getFeed(bson.M{"title": bson.M{"$regex": "^((?!fii))", "$options": "i"}}, "all", baseURL)
+func serveFeed(w http.ResponseWriter, r *http.Request, name, format string) {
+	config, ok := registry.get(name)
+	if !ok {
+		http.Error(w, "Feed not found", http.StatusNotFound)
+		return
+	}
+	writeFeed(w, r, config, format)
+}
+
+// writeFeed renders the feed in the given format. An empty format means that
+// the format should be negotiated with the client.
+func writeFeed(w http.ResponseWriter, r *http.Request, config FeedConfig, format string) {
+	if format == "" {
+		format = negotiateFormat(r)
+		w.Header().Add("Vary", "Accept")
+	}
+	baseURL := requestBaseURL(r)
+	metadata := registry.getMetadata()
+	latest, err := latestNews(config)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	atom, err := feed.ToAtom()
+	key := cacheKey(config, metadata, format, baseURL)
+	etag := feedETag(key, latest)
+	w.Header().Set("ETag", etag)
+	if !latest.Date.IsZero() {
+		w.Header().Set("Last-Modified", latest.LastModified().UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, latest.LastModified()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	content, err := feedContent(config, metadata, format, baseURL, latest)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Add("Content-Type", "application/atom+xml")
-	fmt.Fprint(w, atom)
+	w.Header().Add("Link", hubLinks(baseURL, baseURL+r.URL.RequestURI()))
+	w.Header().Add("Content-Type", feedFormats[format].contentType)
+	fmt.Fprint(w, content)
 }
 
-func feedFIIs(w http.ResponseWriter, r *http.Request) {
-	baseURL := "http://" + r.Host
-	feed, err := getFeed(bson.M{"title": bson.M{"$regex": "^fii", "$options": "i"}}, "fii", baseURL)
+// feedContent returns the feed rendered in the given format, from the cache
+// when possible.
+func feedContent(config FeedConfig, metadata Metadata, format, baseURL string, latest *feedVersion) (string, error) {
+	key := cacheKey(config, metadata, format, baseURL)
+	etag := feedETag(key, latest)
+	if content, ok := cache.get(key, etag); ok {
+		return content, nil
+	}
+	feed, err := getFeed(config, metadata, baseURL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
 	}
-	atom, err := feed.ToAtom()
+	content, err := feedFormats[format].render(feed)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", err
+	}
+	cache.set(key, etag, content)
+	return content, nil
+}
+
+func hubLinks(baseURL, topic string) string {
+	return fmt.Sprintf(`<%s/hub>; rel="hub", <%s>; rel="self"`, baseURL, topic)
+}
+
+// searchFeed builds an ad-hoc feed from the parameters in the query string.
+// The text provided in q is escaped, so it's always matched literally, either
+// in the title or in the body of the news.
+func searchFeed(r *http.Request) (FeedConfig, error) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	params := r.URL.Query()
+	config := FeedConfig{Name: "search", Title: registry.getMetadata().Title + " - Busca"}
+	if q := strings.TrimSpace(params.Get("q")); q != "" {
+		config.text = q
+		config.Title += ": " + q
+	}
+	for _, value := range params["ticker"] {
+		for _, ticker := range strings.Split(value, ",") {
+			if ticker = strings.TrimSpace(ticker); ticker != "" {
+				config.Tickers = append(config.Tickers, strings.ToUpper(ticker))
+			}
+		}
+	}
+	for _, value := range params["category"] {
+		for _, category := range strings.Split(value, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				config.Categories = append(config.Categories, strings.ToLower(category))
+			}
+		}
+	}
+	if since := params.Get("since"); since != "" {
+		date, err := time.ParseInLocation("2006-01-02", since, location)
+		if err != nil {
+			return config, fmt.Errorf("invalid date in since: %q", since)
+		}
+		config.since = date
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return config, fmt.Errorf("invalid limit: %q", limit)
+		}
+		config.Limit = n
+	}
+	return config, nil
+}
+
+func serveSearch(w http.ResponseWriter, r *http.Request, format string) {
+	config, err := searchFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.Header().Add("Content-Type", "application/atom+xml")
-	fmt.Fprint(w, atom)
+	writeFeed(w, r, config, format)
+}
+
+func route(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		browse(w, r)
+		return
+	}
+	if parts := regexpRevisions.FindStringSubmatch(r.URL.Path); len(parts) > 1 {
+		newsRevisions(w, r, parts[1])
+		return
+	}
+	if parts := regexpFeed.FindStringSubmatch(r.URL.Path); len(parts) > 2 {
+		if parts[1] == "search" {
+			serveSearch(w, r, parts[2])
+		} else {
+			serveFeed(w, r, parts[1], parts[2])
+		}
+		return
+	}
+	redirectNews(w, r)
+}
+
+func saveClick(s *mgo.Session, r *http.Request, newsID string) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	now := time.Now().In(location)
+	click := Click{
+		NewsID:    newsID,
+		Feed:      r.URL.Query().Get("feed"),
+		UserAgent: r.UserAgent(),
+		Date:      now,
+		Day:       now.Format("2006-01-02"),
+	}
+	if err := s.DB("").C("clicks").Insert(click); err != nil {
+		log.Printf("[ERROR] Failed to save click in news %s: %s", newsID, err)
+	}
 }
 
+// redirectNews redirects the user to the news in the Bovespa website. It uses
+// a temporary redirect, so every click reaches the service and is recorded.
 func redirectNews(w http.ResponseWriter, r *http.Request) {
 	var newsID string
 	var news News
@@ -146,27 +1014,400 @@ func redirectNews(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 		return
 	}
-	coll, err := collection()
+	coll := collection()
+	defer coll.Database.Session.Close()
+	err := coll.FindId(newsID).One(&news)
+	if err == mgo.ErrNotFound {
+		http.Error(w, "News not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	saveClick(coll.Database.Session, r, newsID)
+	w.Header().Add("Location", news.RedirectURL())
+	w.WriteHeader(http.StatusFound)
+}
+
+// newsRevisions serves the revision history of the given news, from the
+// oldest to the newest revision.
+func newsRevisions(w http.ResponseWriter, r *http.Request, newsID string) {
+	s := mainSession().Copy()
+	defer s.Close()
+	n, err := s.DB("").C("news").FindId(newsID).Count()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer coll.Close()
-	err = coll.FindId(newsID).One(&news)
-	if err == mgo.ErrNotFound {
+	if n == 0 {
 		http.Error(w, "News not found", http.StatusNotFound)
 		return
-	} else if err != nil {
+	}
+	revisions := []Revision{}
+	err = s.DB("").C("revisions").Find(bson.M{"newsid": newsID}).Sort("found").All(&revisions)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Add("Location", news.RedirectURL())
-	w.WriteHeader(http.StatusMovedPermanently)
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// latestRevisions serves the latest revisions of all news, from the newest
+// to the oldest revision.
+func latestRevisions(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit: %q", value), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	s := mainSession().Copy()
+	defer s.Close()
+	revisions := []Revision{}
+	err := s.DB("").C("revisions").Find(nil).Sort("-found").Limit(limit).All(&revisions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// topClicks groups the clicks since the given time by the given field (day or
+// feed), returning the most clicked news in each group.
+func topClicks(s *mgo.Session, field string, since time.Time) (map[string][]NewsClicks, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"date": bson.M{"$gte": since}}},
+		{"$group": bson.M{
+			"_id":    bson.M{"key": "$" + field, "newsid": "$newsid"},
+			"clicks": bson.M{"$sum": 1},
+		}},
+		{"$sort": bson.M{"clicks": -1}},
+	}
+	var groups []struct {
+		ID struct {
+			Key    string
+			NewsID string
+		} `bson:"_id"`
+		Clicks int
+	}
+	err := s.DB("").C("clicks").Pipe(pipeline).All(&groups)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]NewsClicks)
+	var ids []string
+	for _, group := range groups {
+		if len(result[group.ID.Key]) < statsLimit {
+			result[group.ID.Key] = append(result[group.ID.Key], NewsClicks{ID: group.ID.NewsID, Clicks: group.Clicks})
+			ids = append(ids, group.ID.NewsID)
+		}
+	}
+	var newsList []News
+	err = s.DB("").C("news").Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"title": 1}).All(&newsList)
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[string]string, len(newsList))
+	for _, news := range newsList {
+		titles[news.ID] = news.Title
+	}
+	for _, list := range result {
+		for i := range list {
+			list[i].Title = titles[list[i].ID]
+		}
+	}
+	return result, nil
+}
+
+// stats serves, in JSON format, the most clicked news per day and per feed,
+// considering the last days (7 by default, configurable via the days
+// parameter).
+func stats(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid number of days: %q", value), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	now := time.Now().In(location)
+	since := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, location)
+	s := mainSession().Copy()
+	defer s.Close()
+	perDay, err := topClicks(s, "day", since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	perFeed, err := topClicks(s, "feed", since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]map[string][]NewsClicks{
+		"days":  perDay,
+		"feeds": perFeed,
+	})
+}
+
+func pageURL(params url.Values, page int) string {
+	values := make(url.Values, len(params))
+	for key, value := range params {
+		values[key] = value
+	}
+	values.Set("page", strconv.Itoa(page))
+	return "/?" + values.Encode()
+}
+
+// browse serves the HTML interface, listing the news in one of the feeds,
+// filtered by the parameters q (text to search in the title and body), from
+// and to (dates, in the format YYYY-MM-DD).
+func browse(w http.ResponseWriter, r *http.Request) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	params := r.URL.Query()
+	names := registry.names()
+	name := params.Get("feed")
+	if name == "" && len(names) > 0 {
+		name = names[0]
+		if _, ok := registry.get("all"); ok {
+			name = "all"
+		}
+	}
+	config, ok := registry.get(name)
+	if !ok {
+		http.Error(w, "Feed not found", http.StatusNotFound)
+		return
+	}
+	config.text = strings.TrimSpace(params.Get("q"))
+	if from := params.Get("from"); from != "" {
+		date, err := time.ParseInLocation("2006-01-02", from, location)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid date in from: %q", from), http.StatusBadRequest)
+			return
+		}
+		config.since = date
+	}
+	if to := params.Get("to"); to != "" {
+		date, err := time.ParseInLocation("2006-01-02", to, location)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid date in to: %q", to), http.StatusBadRequest)
+			return
+		}
+		config.until = date.AddDate(0, 0, 1)
+	}
+	page := 1
+	if value := params.Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid page: %q", value), http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var newsList []News
+	err := coll.Find(config.query()).Select(bson.M{"title": 1, "date": 1, "removed": 1, "revised": 1}).Sort("-date").Skip((page - 1) * pageSize).Limit(pageSize + 1).All(&newsList)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := map[string]interface{}{
+		"Title": registry.getMetadata().Title,
+		"Feeds": names,
+		"Feed":  name,
+		"Query": config.text,
+		"From":  params.Get("from"),
+		"To":    params.Get("to"),
+	}
+	if len(newsList) > pageSize {
+		newsList = newsList[:pageSize]
+		data["Next"] = pageURL(params, page+1)
+	}
+	if page > 1 {
+		data["Previous"] = pageURL(params, page-1)
+	}
+	for i := range newsList {
+		newsList[i].Date = newsList[i].Date.In(location)
+	}
+	data["News"] = newsList
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err = pageTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("[ERROR] Failed to render page: %s", err)
+	}
+}
+
+// topicFeed returns the feed identified by the topic URL, which must be the
+// URL of one of the feeds served by the service. Topics without extension
+// are delivered in Atom format.
+func topicFeed(topic string) (config FeedConfig, format, baseURL string, err error) {
+	r, err := http.NewRequest("GET", topic, nil)
+	if err != nil {
+		return config, "", "", err
+	}
+	parts := regexpFeed.FindStringSubmatch(r.URL.Path)
+	if (r.URL.Scheme != "http" && r.URL.Scheme != "https") || len(parts) < 3 {
+		return config, "", "", fmt.Errorf("invalid topic: %q", topic)
+	}
+	baseURL = r.URL.Scheme + "://" + r.URL.Host
+	if publicURL != "" && baseURL != strings.TrimSuffix(publicURL, "/") {
+		return config, "", "", fmt.Errorf("invalid topic: %q", topic)
+	}
+	format = parts[2]
+	if format == "" {
+		format = "atom"
+	}
+	if parts[1] == "search" {
+		config, err = searchFeed(r)
+		return config, format, baseURL, err
+	}
+	config, ok := registry.get(parts[1])
+	if !ok {
+		return config, "", "", fmt.Errorf("feed not found: %q", topic)
+	}
+	return config, format, baseURL, nil
+}
+
+// validTopic checks whether the topic is one of the feeds served by the
+// service, in the host used in the subscription request.
+func validTopic(r *http.Request, topic string) error {
+	_, _, baseURL, err := topicFeed(topic)
+	if err != nil {
+		return err
+	}
+	if baseURL != requestBaseURL(r) {
+		return fmt.Errorf("invalid topic: %q", topic)
+	}
+	return nil
+}
+
+// subscriptionStore stores the subscriptions of the hub in MongoDB.
+type subscriptionStore struct{}
+
+func (subscriptionStore) Save(sub *lib.Subscription) error {
+	s := mainSession().Copy()
+	defer s.Close()
+	_, err := s.DB("").C("subscriptions").Upsert(bson.M{"callback": sub.Callback, "topic": sub.Topic}, sub)
+	return err
+}
+
+func (subscriptionStore) Remove(sub *lib.Subscription) error {
+	s := mainSession().Copy()
+	defer s.Close()
+	err := s.DB("").C("subscriptions").Remove(bson.M{"callback": sub.Callback, "topic": sub.Topic})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func logVerification(mode string, sub lib.Subscription, err error) {
+	if err != nil {
+		log.Printf("[WARNING] Failed to %s %s to %s: %s", mode, sub.Callback, sub.Topic, err)
+	}
+}
+
+// publish delivers the current version of each topic to its subscribers,
+// removing the expired subscriptions.
+func publish() {
+	s := mainSession().Copy()
+	defer s.Close()
+	coll := s.DB("").C("subscriptions")
+	_, err := coll.RemoveAll(bson.M{"expires": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		log.Printf("[ERROR] Failed to remove expired subscriptions: %s", err)
+	}
+	var subs []lib.Subscription
+	err = coll.Find(nil).Sort("topic").All(&subs)
+	if err != nil {
+		log.Printf("[ERROR] Failed to load subscriptions: %s", err)
+		return
+	}
+	metadata := registry.getMetadata()
+	var content, topic string
+	var contentErr error
+	for _, sub := range subs {
+		if sub.Topic != topic {
+			topic = sub.Topic
+			content, contentErr = topicContent(topic, metadata)
+			if contentErr != nil {
+				log.Printf("[ERROR] Failed to render topic %s: %s", topic, contentErr)
+			}
+		}
+		if contentErr == nil {
+			go deliver(sub, content)
+		}
+	}
+}
+
+func topicContent(topic string, metadata Metadata) (string, error) {
+	config, format, baseURL, err := topicFeed(topic)
+	if err != nil {
+		return "", err
+	}
+	latest, err := latestNews(config)
+	if err != nil {
+		return "", err
+	}
+	return feedContent(config, metadata, format, baseURL, latest)
+}
+
+// deliver sends the content of the topic to the subscriber.
+func deliver(sub lib.Subscription, content string) {
+	_, format, baseURL, err := topicFeed(sub.Topic)
+	if err == nil {
+		err = webHub.Deliver(sub, feedFormats[format].contentType, hubLinks(baseURL, sub.Topic), content)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to deliver %s to %s: %s", sub.Topic, sub.Callback, err)
+	}
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	if mainSession() == nil {
+		http.Error(w, "MongoDB: not connected", http.StatusServiceUnavailable)
+		return
+	}
+	s := mainSession().Copy()
+	defer s.Close()
+	if err := s.Ping(); err != nil {
+		http.Error(w, "MongoDB: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "WORKING")
 }
 
 func main() {
-	http.Handle("/all.atom", http.HandlerFunc(feedAll))
-	http.Handle("/fii.atom", http.HandlerFunc(feedFIIs))
-	http.Handle("/", http.HandlerFunc(redirectNews))
+	if err := loadFeeds(); err != nil {
+		log.Fatal(err)
+	}
+	go connectLoop()
+	go reloadOnSignal()
+	webHub = &lib.Hub{
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		Store:         subscriptionStore{},
+		PublishSecret: publishSecret,
+		ValidTopic:    validTopic,
+		Publish:       publish,
+		Verified:      logVerification,
+	}
+	http.Handle("/health", http.HandlerFunc(health))
+	http.Handle("/stats", available(http.HandlerFunc(stats)))
+	http.Handle("/hub", available(webHub))
+	http.Handle("/revisions", available(http.HandlerFunc(latestRevisions)))
+	http.Handle("/", available(http.HandlerFunc(route)))
 	http.ListenAndServe(listenHTTP, nil)
 }
@@ -2,13 +2,91 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// This bot sends, by email, news about FIIs stored by plantao_empresas.
+//
+// Which news are sent is defined by a list of rules, loaded from the JSON file
+// provided in the -c flag. Each rule may define patterns (regular expressions
+// matched against the title, in lower case and without accents), tickers
+// (matched against the tickers mentioned in the title, ignoring the suffix,
+// so HGLG11 also matches HGLG) and document types (see docTypes). A news
+// matches a rule when it matches all the criteria defined in the rule, and
+// the first matching rule is recorded in the notification. Example:
+//
+//	{
+//		"rules": [
+//			{"name": "relatorios", "types": ["relatorio", "carta", "informe-mensal"]},
+//			{"name": "carteira", "tickers": ["HGLG11", "KNRI11"], "types": ["fato-relevante", "rendimento"]},
+//			{"name": "emissoes", "patterns": ["\\bemissao de (novas )?cotas\\b"]}
+//		]
+//	}
+//
+// Only news about FIIs (with titles starting with "FII") are considered. When
+// -c is not provided, the bot sends managerial reports and letters of all
+// FIIs. Each recipient may restrict the rules that apply to them, by name
+// (see the set-rules command below); by default, all rules apply.
+//
+// Each news is sent at most once to each recipient, which is enforced by a
+// unique index in the notifications collection. For each recipient, the bot
+// stores a watermark, with the date of the newest news already examined, and
+// only examines news published after the watermark, minus the interval
+// provided in -l, which covers news stored late. When there's no watermark,
+// the bot starts from the current time minus -l.
+//
+// Matching news are queued in the notifications collection and delivered
+// one by one. Failed deliveries are retried with exponential backoff,
+// starting at -retry-backoff, and, after -max-attempts attempts, they're moved
+// to the dead-letter list, which can be inspected and requeued:
+//
+//	fii_report failures
+//	fii_report requeue [<email> [<news id>|<month>]]
+//
+// Recipients are stored in the recipients collection, along with the FIIs
+// they hold, and each news is only sent to holders of the FII (the recipient
+// provided in -r, if any, receives all news). Recipients and holdings are
+// managed with the following commands:
+//
+//	fii_report recipients
+//	fii_report add-recipient <email>
+//	fii_report remove-recipient <email>
+//	fii_report set-holding <email> <ticker> [<quotas>]
+//	fii_report remove-holding <email> <ticker>
+//	fii_report set-rules <email> [<rule>...]
+//
+// Announcements of distributions (rendimentos) are parsed into the
+// distributions collection, with the value per quota, the data-com and the
+// payment date. When -http is provided, the bot serves, in JSON format, the
+// distributions of the last 12 months at /distributions and the trailing 12
+// months dividend yield of each FII at /yields, using the last price in
+// BM&FBovespa. Both accept the ticker parameter, which may be repeated. Prices
+// are fetched in background, on startup and on each tick, so /yields never
+// waits for BM&FBovespa, and yields of FIIs without a price yet are served
+// with an error.
+//
+// Every month, starting on the day provided in -income-day, each recipient
+// with holdings receives a summary of the distributions to be paid in the
+// month, with the expected income per FII (based on the number of quotas in
+// the holdings), the total and the changes from the previous month. Reports
+// are stored before being sent, and claimed for delivery, so concurrent runs
+// don't send them twice. Claims expire after a few minutes, so reports are
+// still delivered when the process dies while sending them. Failed reports are
+// retried like notifications, and listed and requeued by the same commands
+// (using the month, in the format MM/YYYY, instead of the news id).
 package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -21,42 +99,412 @@ const (
 	dbName                = "bovespa_plantao_empresas"
 	newsCollName          = "news"
 	notificationsCollName = "notifications"
+	watermarksCollName    = "watermarks"
+	recipientsCollName    = "recipients"
+	distributionsCollName = "distributions"
+	incomeReportsCollName = "income_reports"
+
+	// quoteTTL is how long quotes are cached before being fetched again.
+	quoteTTL = 15 * time.Minute
 )
 
 var emailTemplate = template.Must(template.New("report").Parse(`Subject: {{.subject}}
 To: {{.recipient}}
 From: {{.sender}}
+X-Report-Rule: {{.rule}}
 
 {{.subject}}
 
+Regra: {{.rule}}
+
 {{.link}}`))
 
+var incomeTemplate = template.Must(template.New("income").Funcs(template.FuncMap{"brl": formatBRL, "change": formatChange}).Parse(`Subject: Rendimentos previstos - {{.Month}}
+To: {{.Recipient}}
+From: {{.Sender}}
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+
+Rendimentos previstos para {{.Month}}
+{{range .Lines}}
+{{.Ticker}}: {{.Quotas}} cota(s) x {{brl .Amount}} = {{brl .Expected}}{{if .PaymentDates}} (pagamento em {{.PaymentDates}}){{end}}
+    Mês anterior: {{brl .Previous}} ({{change .Expected .Previous}})
+{{end}}
+Total: {{brl .Total}}
+Mês anterior: {{brl .PreviousTotal}} ({{change .Total .PreviousTotal}})
+{{if .Missing}}
+Fundos sem rendimento anunciado: {{.Missing}}
+{{end}}`))
+
+// docTypes maps the names of the document types that can be used in rules to
+// the regular expressions that identify them in the title, in lower case and
+// without accents.
+var docTypes = map[string]*regexp.Regexp{
+	"relatorio":          regexp.MustCompile(`\brelatorios?\b`),
+	"carta":              regexp.MustCompile(`\bcartas?\b`),
+	"informe-mensal":     regexp.MustCompile(`\binformes? mensa(l|is)\b`),
+	"informe-trimestral": regexp.MustCompile(`\binformes? trimestra(l|is)\b`),
+	"fato-relevante":     regexp.MustCompile(`\bfatos? relevantes?\b`),
+	"rendimento":         regexp.MustCompile(`\b(rendimentos?|distribuicao|amortizacao)\b`),
+	"assembleia":         regexp.MustCompile(`\b(assembleia|ago|age|edital de convocacao)\b`),
+}
+
+// distributionTitle identifies, in lower case and without accents, titles of
+// news that may announce distributions.
+var distributionTitle = regexp.MustCompile(`\b(rendimentos?|distribuicao|aviso aos cotistas)\b`)
+
+var defaultRules = []Rule{
+	{Name: "relatorios", Types: []string{"relatorio", "carta"}},
+}
+
 var (
-	baseURL    string
-	sender     string
-	password   string
-	recipient  string
-	tickerTime time.Duration
+	baseURL      string
+	sender       string
+	password     string
+	recipient    string
+	configFile   string
+	tickerTime   time.Duration
+	lookback     time.Duration
+	listenHTTP   string
+	incomeDay    int
+	maxAttempts  int
+	retryBackoff time.Duration
+	rules        []Rule
+	fetcher      = lib.NewFetcher()
+	quotes       quoteCache
 )
 
 type News struct {
-	ID    string `bson:"_id"`
-	Title string
-	Date  time.Time
+	ID      string `bson:"_id"`
+	Title   string
+	Date    time.Time
+	Tickers []string
+	Body    string `bson:",omitempty"`
 }
 
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	StatusFailed  = "failed"
+	StatusDead    = "dead"
+
+	// StatusSending marks income reports claimed for delivery. The claim
+	// expires after sendingLease.
+	StatusSending = "sending"
+	sendingLease  = 10 * time.Minute
+)
+
+// Notification is the delivery of a news to a recipient. Notifications
+// stored before delivery states were introduced don't have a status, and were
+// sent.
 type Notification struct {
-	NewsID    string
-	Date      time.Time
-	Recipient string
+	NewsID      string
+	Title       string `bson:",omitempty"`
+	Date        time.Time
+	Recipient   string
+	Rule        string
+	Status      string    `bson:",omitempty"`
+	Attempts    int       `bson:",omitempty"`
+	LastError   string    `bson:",omitempty"`
+	NextAttempt time.Time `bson:",omitempty"`
+}
+
+// Recipient is a person that receives news about the FIIs in Holdings. When
+// Rules is not empty, only the rules with the given names apply to the
+// recipient.
+type Recipient struct {
+	Email    string `bson:"_id"`
+	Holdings []Holding
+	Rules    []string `bson:",omitempty"`
+
+	// all indicates that the recipient receives news about all FIIs.
+	all bool
+}
+
+// Holding is a position of a recipient in a FII.
+type Holding struct {
+	Ticker string
+	Quotas int
+}
+
+// holds checks whether the recipient holds any of the FIIs mentioned in the
+// news.
+func (r *Recipient) holds(news *News) bool {
+	if r.all {
+		return true
+	}
+	for _, holding := range r.Holdings {
+		for _, ticker := range news.Tickers {
+			if tickerRoot(holding.Ticker) == tickerRoot(ticker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Watermark is the date of the newest news examined for a recipient, or for
+// parsing distributions.
+type Watermark struct {
+	Name string `bson:"_id"`
+	Date time.Time
+}
+
+// Distribution is a distribution announced in a news.
+type Distribution struct {
+	NewsID      string `bson:"_id"`
+	NewsDate    time.Time
+	Ticker      string
+	Amount      float64
+	DataCom     time.Time `bson:",omitempty"`
+	PaymentDate time.Time `bson:",omitempty"`
+}
+
+// Yield is the trailing 12 months dividend yield of a FII.
+type Yield struct {
+	Ticker        string
+	Price         float64
+	Distributions int
+	Amount        float64
+	Yield         float64
+	Error         string `json:",omitempty"`
+}
+
+type cachedQuote struct {
+	price float64
+	err   error
+	date  time.Time
+}
+
+type quoteCache struct {
+	quotes map[string]cachedQuote
+	mutex  sync.Mutex
+}
+
+// get returns the cached price of the ticker, or the error of the latest
+// attempt to fetch it. It never fetches the price (see refresh).
+func (c *quoteCache) get(ticker string) (float64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	quote, ok := c.quotes[ticker]
+	if !ok {
+		return 0, fmt.Errorf("quote not available yet: %s", ticker)
+	}
+	if quote.err != nil && quote.price == 0 {
+		return 0, quote.err
+	}
+	return quote.price, nil
+}
+
+// refresh fetches the prices of the tickers that are not cached or that are
+// older than quoteTTL. When fetching fails, the previous price is kept.
+func (c *quoteCache) refresh(tickers []string) {
+	for _, ticker := range tickers {
+		c.mutex.Lock()
+		quote, ok := c.quotes[ticker]
+		c.mutex.Unlock()
+		if ok && time.Since(quote.date) < quoteTTL {
+			continue
+		}
+		price, err := fetcher.Quote(ticker)
+		if err != nil {
+			log.Printf("ERROR: failed to fetch the quote of %s: %s", ticker, err)
+			quote.err = err
+		} else {
+			quote = cachedQuote{price: price}
+		}
+		quote.date = time.Now()
+		c.mutex.Lock()
+		if c.quotes == nil {
+			c.quotes = make(map[string]cachedQuote)
+		}
+		c.quotes[ticker] = quote
+		c.mutex.Unlock()
+	}
+}
+
+// refreshQuotes refreshes the prices of the FIIs with distributions in the
+// last 12 months, which are used by /yields.
+func refreshQuotes() error {
+	distributions, err := getDistributions(nil, time.Now().AddDate(-1, 0, 0))
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	var tickers []string
+	for _, d := range distributions {
+		if !seen[d.Ticker] {
+			seen[d.Ticker] = true
+			tickers = append(tickers, d.Ticker)
+		}
+	}
+	quotes.refresh(tickers)
+	return nil
+}
+
+// poolQuotes refreshes the quotes right away and then on every tick, in its
+// own goroutine, so slow responses from BM&FBovespa don't delay the delivery
+// of news.
+func poolQuotes(ticker <-chan time.Time) {
+	for {
+		if err := refreshQuotes(); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+		<-ticker
+	}
+}
+
+// Rule defines which news are sent. Empty criteria match all news.
+type Rule struct {
+	Name     string   `json:"name"`
+	Patterns []string `json:"patterns"`
+	Tickers  []string `json:"tickers"`
+	Types    []string `json:"types"`
+
+	patterns []*regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule without name")
+	}
+	r.patterns = nil
+	for _, pattern := range r.Patterns {
+		re, err := regexp.Compile(lib.Fold(pattern))
+		if err != nil {
+			return fmt.Errorf("rule %q: %s", r.Name, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, docType := range r.Types {
+		if _, ok := docTypes[docType]; !ok {
+			return fmt.Errorf("rule %q: unknown document type %q", r.Name, docType)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(news *News) bool {
+	title := lib.Fold(news.Title)
+	return r.matchPatterns(title) && r.matchTickers(news) && r.matchTypes(title)
+}
+
+func (r *Rule) matchPatterns(title string) bool {
+	if len(r.patterns) == 0 {
+		return true
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchTickers(news *News) bool {
+	if len(r.Tickers) == 0 {
+		return true
+	}
+	for _, ticker := range r.Tickers {
+		for _, newsTicker := range news.Tickers {
+			if tickerRoot(ticker) == tickerRoot(newsTicker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchTypes(title string) bool {
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, docType := range r.Types {
+		if docTypes[docType].MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+func tickerRoot(ticker string) string {
+	ticker = strings.ToUpper(ticker)
+	if len(ticker) > 4 {
+		return ticker[:4]
+	}
+	return ticker
+}
+
+// matchRule returns the first rule of the recipient matched by the news.
+func (r *Recipient) matchRule(news *News) (*Rule, bool) {
+	for i := range rules {
+		if r.hasRule(rules[i].Name) && rules[i].match(news) {
+			return &rules[i], true
+		}
+	}
+	return nil, false
+}
+
+func (r *Recipient) hasRule(name string) bool {
+	if len(r.Rules) == 0 {
+		return true
+	}
+	for _, rule := range r.Rules {
+		if rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleExists(name string) bool {
+	for _, rule := range rules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func loadRules() error {
+	rules = defaultRules
+	if configFile != "" {
+		file, err := os.Open(configFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		var config struct {
+			Rules []Rule `json:"rules"`
+		}
+		if err = json.NewDecoder(file).Decode(&config); err != nil {
+			return err
+		}
+		if len(config.Rules) == 0 {
+			return fmt.Errorf("no rules defined in %s", configFile)
+		}
+		rules = config.Rules
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func init() {
 	flag.StringVar(&sender, "s", "", "Email address of the sender, for authentication in Gmail")
 	flag.StringVar(&password, "p", "", "Email password of the sender, for authentication in Gmail")
-	flag.StringVar(&recipient, "r", "", "Email address of the recipient")
+	flag.StringVar(&recipient, "r", "", "Email address of a recipient that receives news about all FIIs")
 	flag.StringVar(&baseURL, "u", "", "Base URL")
+	flag.StringVar(&configFile, "c", "", "JSON file with the rules that define which news are sent")
 	flag.DurationVar(&tickerTime, "t", time.Minute, "Ticker interval")
+	flag.DurationVar(&lookback, "l", 72*time.Hour, "How far before the watermark news are examined")
+	flag.IntVar(&maxAttempts, "max-attempts", 5, "Number of attempts before moving a notification to the dead-letter list")
+	flag.DurationVar(&retryBackoff, "retry-backoff", time.Minute, "Time to wait before retrying a failed notification, doubled on each attempt")
+	flag.IntVar(&incomeDay, "income-day", 1, "Day of the month in which the expected income is sent")
+	flag.StringVar(&listenHTTP, "http", "", "Address for serving distributions and dividend yields (disabled when empty)")
 }
 
 func connect() (*mgo.Session, error) {
@@ -65,106 +513,933 @@ func connect() (*mgo.Session, error) {
 
 func notificationsCollection(session *mgo.Session) *mgo.Collection {
 	collection := session.DB(dbName).C(notificationsCollName)
-	collection.EnsureIndex(mgo.Index{Key: []string{"newsid"}, Background: true})
+	collection.EnsureIndex(mgo.Index{Key: []string{"newsid", "recipient"}, Unique: true, Background: true})
+	collection.EnsureIndex(mgo.Index{Key: []string{"status", "nextattempt"}, Background: true, Sparse: true})
 	return collection
 }
 
 func poolRecords(ticker <-chan time.Time) {
 	for _ = range ticker {
-		records := getRecords()
-		if len(records) > 0 {
-			notifyRecords(records)
+		if err := parseDistributions(); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+		recipients, err := getRecipients()
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			continue
+		}
+		for _, r := range recipients {
+			poolRecipient(&r)
+		}
+		if err := deliverNotifications(); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+		if err := sendIncomeReports(recipients, time.Now()); err != nil {
+			log.Printf("ERROR: %s", err)
 		}
 	}
 }
 
-func getNotificatedNews() ([]string, error) {
+func poolRecipient(r *Recipient) {
+	records, newest := getRecords(r)
+	var held []Record
+	for _, record := range records {
+		if r.holds(&record.News) {
+			held = append(held, record)
+		}
+	}
+	if len(held) > 0 {
+		if err := queueRecords(r.Email, held); err != nil {
+			log.Printf("ERROR: %s", err)
+			return
+		}
+	}
+	if !newest.IsZero() {
+		if err := saveWatermark(r.Email, newest); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+	}
+}
+
+// getRecipients returns the recipients stored in the database, along with the
+// recipient provided in the command line.
+func getRecipients() ([]Recipient, error) {
 	session, err := connect()
 	if err != nil {
 		return nil, err
 	}
 	defer session.Close()
+	var recipients []Recipient
+	err = session.DB(dbName).C(recipientsCollName).Find(nil).All(&recipients)
+	if err != nil {
+		return nil, err
+	}
+	if recipient != "" {
+		for i := range recipients {
+			if recipients[i].Email == recipient {
+				recipients[i].all = true
+				return recipients, nil
+			}
+		}
+		recipients = append(recipients, Recipient{Email: recipient, all: true})
+	}
+	return recipients, nil
+}
+
+// getWatermark returns the watermark with the given name, or the zero time,
+// if there's no such watermark.
+func getWatermark(session *mgo.Session, name string) (time.Time, error) {
+	var watermark Watermark
+	err := session.DB(dbName).C(watermarksCollName).FindId(name).One(&watermark)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	}
+	return watermark.Date, err
+}
+
+func saveWatermark(name string, date time.Time) error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	collection := session.DB(dbName).C(watermarksCollName)
+	_, err = collection.UpsertId(name, bson.M{"$max": bson.M{"date": date}})
+	return err
+}
+
+// getNotifiedNews returns which of the given news were already sent to the
+// recipient.
+func getNotifiedNews(session *mgo.Session, recipient string, ids []string) (map[string]bool, error) {
 	collection := notificationsCollection(session)
 	var notifications []Notification
-	err = collection.Find(nil).Select(bson.M{"newsid": 1}).All(&notifications)
+	query := bson.M{"recipient": recipient, "newsid": bson.M{"$in": ids}}
+	err := collection.Find(query).Select(bson.M{"newsid": 1}).All(&notifications)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]string, len(notifications))
-	for i, notification := range notifications {
-		result[i] = notification.NewsID
+	result := make(map[string]bool, len(notifications))
+	for _, notification := range notifications {
+		result[notification.NewsID] = true
 	}
 	return result, nil
 }
 
-func getRecords() []News {
+// Record is a news that matched one of the rules.
+type Record struct {
+	News News
+	Rule string
+}
+
+// getRecords returns the news that should be sent to the recipient, along
+// with the date of the newest news examined, which becomes the new watermark
+// once the records are sent.
+func getRecords(r *Recipient) ([]Record, time.Time) {
 	session, err := connect()
 	if err != nil {
 		log.Printf("ERROR: %s", err)
-		return nil
+		return nil, time.Time{}
 	}
 	defer session.Close()
-	notificated, err := getNotificatedNews()
+	watermark, err := getWatermark(session, r.Email)
 	if err != nil {
 		log.Printf("ERROR: %s", err)
-		return nil
+		return nil, time.Time{}
+	}
+	if watermark.IsZero() {
+		watermark = time.Now()
 	}
 	collection := session.DB(dbName).C(newsCollName)
 	var newsList []News
 	query := bson.M{
-		"_id":   bson.M{"$nin": notificated},
-		"title": bson.M{"$regex": "^fii.*(relatorio|carta)", "$options": "i"},
+		"date":  bson.M{"$gte": watermark.Add(-lookback)},
+		"title": bson.M{"$regex": "^fii", "$options": "i"},
 	}
-	err = collection.Find(query).All(&newsList)
+	err = collection.Find(query).Select(bson.M{"title": 1, "date": 1, "tickers": 1}).Sort("date").All(&newsList)
 	if err != nil {
 		log.Printf("ERROR: %s", err)
-		return nil
+		return nil, time.Time{}
+	}
+	if len(newsList) == 0 {
+		return nil, time.Time{}
 	}
-	return newsList
+	ids := make([]string, len(newsList))
+	for i, news := range newsList {
+		ids[i] = news.ID
+	}
+	notified, err := getNotifiedNews(session, r.Email, ids)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil, time.Time{}
+	}
+	var records []Record
+	for _, news := range newsList {
+		if notified[news.ID] {
+			continue
+		}
+		if rule, ok := r.matchRule(&news); ok {
+			records = append(records, Record{News: news, Rule: rule.Name})
+		}
+	}
+	return records, newsList[len(newsList)-1].Date
 }
 
-func notifyRecords(newsList []News) {
-	mailSender, err := lib.NewGmailSender(sender, password)
+// queueRecords stores the records as pending notifications to the
+// recipient.
+func queueRecords(recipient string, records []Record) error {
+	session, err := connect()
 	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return
+		return err
 	}
-	defer mailSender.Close()
+	defer session.Close()
+	collection := notificationsCollection(session)
+	now := time.Now()
+	for _, record := range records {
+		err = collection.Insert(Notification{
+			NewsID:      record.News.ID,
+			Title:       record.News.Title,
+			Recipient:   recipient,
+			Rule:        record.Rule,
+			Status:      StatusPending,
+			NextAttempt: now,
+		})
+		if err != nil && !mgo.IsDup(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverNotifications sends the pending notifications, along with the
+// failed notifications that are due for a retry. A failure doesn't stop the
+// delivery of the other notifications.
+func deliverNotifications() error {
 	session, err := connect()
 	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return
+		return err
 	}
 	defer session.Close()
-	for _, news := range newsList {
+	collection := notificationsCollection(session)
+	var notifications []Notification
+	query := bson.M{
+		"status":      bson.M{"$in": []string{StatusPending, StatusFailed}},
+		"nextattempt": bson.M{"$lte": time.Now()},
+	}
+	err = collection.Find(query).Sort("nextattempt").All(&notifications)
+	if err != nil || len(notifications) == 0 {
+		return err
+	}
+	mailSender, err := lib.NewGmailSender(sender, password)
+	if err != nil {
+		return err
+	}
+	defer mailSender.Close()
+	var sent, failed int
+	for _, n := range notifications {
 		var body bytes.Buffer
 		emailTemplate.Execute(&body, map[string]string{
-			"subject":   news.Title,
-			"recipient": recipient,
+			"subject":   n.Title,
+			"recipient": n.Recipient,
 			"sender":    sender,
-			"link":      baseURL + news.ID,
+			"link":      baseURL + n.NewsID,
+			"rule":      n.Rule,
 		})
-		err := mailSender.SendMail(recipient, body.Bytes())
+		selector := bson.M{"newsid": n.NewsID, "recipient": n.Recipient}
+		var update bson.M
+		if err := mailSender.SendMail(n.Recipient, body.Bytes()); err != nil {
+			log.Printf("ERROR: failed to send news %s to %s: %s", n.NewsID, n.Recipient, err)
+			failed++
+			update = failedUpdate(n.Attempts, err, time.Now())
+		} else {
+			sent++
+			update = bson.M{
+				"$set":   bson.M{"status": StatusSent, "date": time.Now()},
+				"$unset": bson.M{"nextattempt": 1},
+				"$inc":   bson.M{"attempts": 1},
+			}
+		}
+		if err := collection.Update(selector, update); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+	}
+	log.Printf("Sent %d notification(s), %d failure(s).", sent, failed)
+	return nil
+}
+
+// failedUpdate returns the update for a notification or income report that
+// failed to be sent after the given number of previous attempts, scheduling
+// the next attempt or moving it to the dead-letter list.
+func failedUpdate(previousAttempts int, err error, now time.Time) bson.M {
+	attempts := previousAttempts + 1
+	fields := bson.M{"lasterror": err.Error(), "attempts": attempts}
+	if attempts >= maxAttempts {
+		fields["status"] = StatusDead
+		return bson.M{"$set": fields, "$unset": bson.M{"nextattempt": 1}}
+	}
+	fields["status"] = StatusFailed
+	fields["nextattempt"] = now.Add(retryBackoff << uint(attempts-1))
+	return bson.M{"$set": fields}
+}
+
+// listFailures prints the notifications and income reports that failed,
+// including the ones in the dead-letter list.
+func listFailures() error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	var notifications []Notification
+	query := bson.M{"status": bson.M{"$in": []string{StatusFailed, StatusDead}}}
+	err = notificationsCollection(session).Find(query).Sort("recipient", "newsid").All(&notifications)
+	if err != nil {
+		return err
+	}
+	for _, n := range notifications {
+		fmt.Printf("%s\t%s\t%s\t%d attempt(s)\t%s\t%s\n", n.Status, n.Recipient, n.NewsID, n.Attempts, n.Title, n.LastError)
+	}
+	var reports []IncomeReport
+	err = session.DB(dbName).C(incomeReportsCollName).Find(query).Sort("recipient", "month").All(&reports)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		fmt.Printf("%s\t%s\t%s\t%d attempt(s)\tRendimentos previstos\t%s\n", r.Status, r.Recipient, r.Month, r.Attempts, r.LastError)
+	}
+	return nil
+}
+
+// requeue moves notifications and income reports in the dead-letter list
+// back to the queue, optionally filtering by recipient and by news (or month,
+// for income reports).
+func requeue(args []string) error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	selector := bson.M{"status": StatusDead}
+	reportSelector := bson.M{"status": StatusDead}
+	if len(args) > 0 {
+		selector["recipient"] = args[0]
+		reportSelector["recipient"] = args[0]
+	}
+	if len(args) > 1 {
+		selector["newsid"] = args[1]
+		reportSelector["month"] = args[1]
+	}
+	update := bson.M{
+		"$set":   bson.M{"status": StatusPending, "attempts": 0, "nextattempt": time.Now()},
+		"$unset": bson.M{"lasterror": 1},
+	}
+	info, err := notificationsCollection(session).UpdateAll(selector, update)
+	if err != nil {
+		return err
+	}
+	reportsInfo, err := session.DB(dbName).C(incomeReportsCollName).UpdateAll(reportSelector, update)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Requeued %d notification(s) and %d income report(s).\n", info.Updated, reportsInfo.Updated)
+	return nil
+}
+
+// parseDistributions parses the distributions announced in news published
+// since the last run (minus -l, as bodies may be downloaded late). In the
+// first run, all news are parsed.
+func parseDistributions() error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	watermark, err := getWatermark(session, distributionsCollName)
+	if err != nil {
+		return err
+	}
+	query := bson.M{
+		"title": bson.M{"$regex": "^fii", "$options": "i"},
+		"body":  bson.M{"$exists": true},
+	}
+	if !watermark.IsZero() {
+		query["date"] = bson.M{"$gte": watermark.Add(-lookback)}
+	}
+	collection := session.DB(dbName).C(distributionsCollName)
+	var (
+		news   News
+		newest time.Time
+		count  int
+	)
+	iter := session.DB(dbName).C(newsCollName).Find(query).Select(bson.M{"title": 1, "date": 1, "tickers": 1, "body": 1}).Iter()
+	for iter.Next(&news) {
+		if news.Date.After(newest) {
+			newest = news.Date
+		}
+		if !distributionTitle.MatchString(lib.Fold(news.Title)) {
+			continue
+		}
+		d, ok := lib.ParseDistribution(news.Body)
+		if !ok {
+			continue
+		}
+		if d.Ticker == "" {
+			d.Ticker = newsTicker(&news)
+		}
+		if d.Ticker == "" {
+			log.Printf("WARNING: distribution without ticker in news %s", news.ID)
+			continue
+		}
+		_, err = collection.UpsertId(news.ID, Distribution{
+			NewsID:      news.ID,
+			NewsDate:    news.Date,
+			Ticker:      d.Ticker,
+			Amount:      d.Amount,
+			DataCom:     d.DataCom,
+			PaymentDate: d.PaymentDate,
+		})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		count++
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Printf("Parsed %d distribution(s).", count)
+	}
+	if newest.IsZero() {
+		return nil
+	}
+	return saveWatermark(distributionsCollName, newest)
+}
+
+// newsTicker returns the ticker of the FII mentioned in the title of the
+// news. Titles usually mention only the root of the ticker, and most FIIs are
+// traded with the suffix 11.
+func newsTicker(news *News) string {
+	for _, ticker := range news.Tickers {
+		if strings.HasSuffix(ticker, "11") || strings.HasSuffix(ticker, "11B") {
+			return ticker
+		}
+	}
+	for _, ticker := range news.Tickers {
+		if len(ticker) == 4 {
+			return ticker + "11"
+		}
+	}
+	return ""
+}
+
+// getDistributions returns the distributions of the last 12 months, with
+// data-com (or, when it's unknown, payment date) since the given date, from
+// the newest to the oldest one.
+func getDistributions(tickers []string, since time.Time) ([]Distribution, error) {
+	session, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	query := bson.M{"$or": []bson.M{
+		{"datacom": bson.M{"$gte": since}},
+		{"datacom": bson.M{"$exists": false}, "paymentdate": bson.M{"$gte": since}},
+	}}
+	if len(tickers) > 0 {
+		query["ticker"] = bson.M{"$in": tickers}
+	}
+	distributions := []Distribution{}
+	err = session.DB(dbName).C(distributionsCollName).Find(query).Sort("-datacom", "-paymentdate").All(&distributions)
+	return distributions, err
+}
+
+// computeYields computes the trailing 12 months dividend yield of each FII in
+// the distributions.
+func computeYields(distributions []Distribution) []Yield {
+	byTicker := make(map[string]*Yield)
+	var tickers []string
+	for _, d := range distributions {
+		y, ok := byTicker[d.Ticker]
+		if !ok {
+			y = &Yield{Ticker: d.Ticker}
+			byTicker[d.Ticker] = y
+			tickers = append(tickers, d.Ticker)
+		}
+		y.Distributions++
+		y.Amount += d.Amount
+	}
+	sort.Strings(tickers)
+	yields := make([]Yield, len(tickers))
+	for i, ticker := range tickers {
+		y := byTicker[ticker]
+		price, err := quotes.get(ticker)
 		if err != nil {
+			y.Error = err.Error()
+		} else if price > 0 {
+			y.Price = price
+			y.Yield = y.Amount / price
+		}
+		yields[i] = *y
+	}
+	return yields
+}
+
+func requestTickers(r *http.Request) []string {
+	var tickers []string
+	for _, ticker := range r.URL.Query()["ticker"] {
+		tickers = append(tickers, strings.ToUpper(ticker))
+	}
+	return tickers
+}
+
+func serveDistributions(w http.ResponseWriter, r *http.Request) {
+	distributions, err := getDistributions(requestTickers(r), time.Now().AddDate(-1, 0, 0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(distributions)
+}
+
+func serveYields(w http.ResponseWriter, r *http.Request) {
+	distributions, err := getDistributions(requestTickers(r), time.Now().AddDate(-1, 0, 0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(computeYields(distributions))
+}
+
+// IncomeLine is the expected income from one of the holdings in a month.
+type IncomeLine struct {
+	Ticker       string
+	Quotas       int
+	Amount       float64
+	Expected     float64
+	Previous     float64
+	PaymentDates string
+}
+
+// IncomeReport is the expected income of a recipient in a month. Reports are
+// stored before they're sent, with the same delivery states of notifications.
+type IncomeReport struct {
+	Recipient     string
+	Month         string
+	Lines         []IncomeLine
+	Total         float64
+	PreviousTotal float64
+	Missing       string `bson:",omitempty"`
+	Sender        string `bson:"-"`
+	Date          time.Time
+	Status        string    `bson:",omitempty"`
+	Attempts      int       `bson:",omitempty"`
+	LastError     string    `bson:",omitempty"`
+	NextAttempt   time.Time `bson:",omitempty"`
+}
+
+// formatBRL formats the value in BRL, in the Brazilian format (R$ 1.234,56).
+func formatBRL(value float64) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	cents := int64(value*100 + 0.5)
+	integer := strconv.FormatInt(cents/100, 10)
+	var parts []string
+	for len(integer) > 3 {
+		parts = append([]string{integer[len(integer)-3:]}, parts...)
+		integer = integer[:len(integer)-3]
+	}
+	parts = append([]string{integer}, parts...)
+	return fmt.Sprintf("%sR$ %s,%02d", sign, strings.Join(parts, "."), cents%100)
+}
+
+func formatChange(current, previous float64) string {
+	diff := current - previous
+	switch {
+	case diff > 0.005:
+		return "+" + formatBRL(diff)
+	case diff < -0.005:
+		return formatBRL(diff)
+	}
+	return "sem alteração"
+}
+
+// monthRange returns the first day of the month of t and the first day of
+// the next month, in the America/Sao_Paulo time zone.
+func monthRange(t time.Time) (time.Time, time.Time) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	t = t.In(location)
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// paidBetween returns the distributions with payment date in the given
+// interval, grouped by ticker.
+func paidBetween(session *mgo.Session, tickers []string, start, end time.Time) (map[string][]Distribution, error) {
+	var distributions []Distribution
+	query := bson.M{
+		"ticker":      bson.M{"$in": tickers},
+		"paymentdate": bson.M{"$gte": start, "$lt": end},
+	}
+	err := session.DB(dbName).C(distributionsCollName).Find(query).Sort("paymentdate").All(&distributions)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]Distribution)
+	for _, d := range distributions {
+		result[d.Ticker] = append(result[d.Ticker], d)
+	}
+	return result, nil
+}
+
+// buildIncomeReport computes the expected income of the recipient in the
+// month of t, based on the distributions paid in the month.
+func buildIncomeReport(session *mgo.Session, r *Recipient, t time.Time) (*IncomeReport, error) {
+	start, end := monthRange(t)
+	previousStart, _ := monthRange(start.AddDate(0, 0, -1))
+	var tickers []string
+	for _, holding := range r.Holdings {
+		tickers = append(tickers, holding.Ticker)
+	}
+	current, err := paidBetween(session, tickers, start, end)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := paidBetween(session, tickers, previousStart, start)
+	if err != nil {
+		return nil, err
+	}
+	report := IncomeReport{Recipient: r.Email, Month: start.Format("01/2006")}
+	var missing []string
+	for _, holding := range r.Holdings {
+		if holding.Quotas <= 0 {
+			continue
+		}
+		line := IncomeLine{Ticker: holding.Ticker, Quotas: holding.Quotas}
+		var dates []string
+		for _, d := range current[holding.Ticker] {
+			line.Amount += d.Amount
+			dates = append(dates, d.PaymentDate.Format("02/01/2006"))
+		}
+		line.PaymentDates = strings.Join(dates, ", ")
+		line.Expected = line.Amount * float64(holding.Quotas)
+		for _, d := range previous[holding.Ticker] {
+			line.Previous += d.Amount * float64(holding.Quotas)
+		}
+		if len(current[holding.Ticker]) == 0 {
+			missing = append(missing, holding.Ticker)
+			if line.Previous == 0 {
+				continue
+			}
+		}
+		report.Lines = append(report.Lines, line)
+		report.Total += line.Expected
+		report.PreviousTotal += line.Previous
+	}
+	report.Missing = strings.Join(missing, ", ")
+	return &report, nil
+}
+
+// sendIncomeReports stores the expected income of the month of the
+// recipients with holdings that don't have it yet, and then sends the reports
+// that are due, including retries and requeued reports of previous months.
+// Each report is claimed before being sent, so concurrent runs don't send it
+// twice, and a failure doesn't stop the delivery to the other recipients.
+func sendIncomeReports(recipients []Recipient, now time.Time) error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	collection := session.DB(dbName).C(incomeReportsCollName)
+	collection.EnsureIndex(mgo.Index{Key: []string{"recipient", "month"}, Unique: true})
+	collection.EnsureIndex(mgo.Index{Key: []string{"status", "nextattempt"}, Background: true, Sparse: true})
+	start, _ := monthRange(now)
+	if now.In(start.Location()).Day() >= incomeDay {
+		month := start.Format("01/2006")
+		for _, r := range recipients {
+			if len(r.Holdings) == 0 {
+				continue
+			}
+			if err := storeIncomeReport(session, &r, month, now); err != nil {
+				log.Printf("ERROR: failed to prepare the income report of %s: %s", r.Email, err)
+			}
+		}
+	}
+	due := bson.M{
+		"status":      bson.M{"$in": []string{StatusPending, StatusFailed, StatusSending}},
+		"nextattempt": bson.M{"$lte": now},
+	}
+	var reports []IncomeReport
+	if err = collection.Find(due).Sort("nextattempt").All(&reports); err != nil || len(reports) == 0 {
+		return err
+	}
+	var mailSender *lib.GmailSender
+	for _, report := range reports {
+		selector := bson.M{"recipient": report.Recipient, "month": report.Month}
+		claim := bson.M{"recipient": report.Recipient, "month": report.Month}
+		for key, value := range due {
+			claim[key] = value
+		}
+		err = collection.Update(claim, bson.M{"$set": bson.M{"status": StatusSending, "nextattempt": now.Add(sendingLease)}})
+		if err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
 			log.Printf("ERROR: %s", err)
-			return
+			continue
+		}
+		report.Sender = sender
+		var body bytes.Buffer
+		if err = incomeTemplate.Execute(&body, report); err != nil {
+			log.Printf("ERROR: %s", err)
+			collection.Update(selector, failedUpdate(report.Attempts, err, time.Now()))
+			continue
+		}
+		if mailSender == nil {
+			if mailSender, err = lib.NewGmailSender(sender, password); err != nil {
+				collection.Update(selector, bson.M{"$set": bson.M{"status": report.Status, "nextattempt": now}})
+				return err
+			}
+			defer mailSender.Close()
+		}
+		var update bson.M
+		if err = mailSender.SendMail(report.Recipient, body.Bytes()); err != nil {
+			log.Printf("ERROR: failed to send the income report of %s to %s: %s", report.Month, report.Recipient, err)
+			update = failedUpdate(report.Attempts, err, time.Now())
+		} else {
+			update = bson.M{
+				"$set":   bson.M{"status": StatusSent, "date": time.Now()},
+				"$unset": bson.M{"nextattempt": 1},
+				"$inc":   bson.M{"attempts": 1},
+			}
+		}
+		if err = collection.Update(selector, update); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+	}
+	return nil
+}
+
+// storeIncomeReport builds and stores the report of the recipient in the
+// month, as pending, unless it's already stored or there's nothing to report.
+func storeIncomeReport(session *mgo.Session, r *Recipient, month string, now time.Time) error {
+	collection := session.DB(dbName).C(incomeReportsCollName)
+	n, err := collection.Find(bson.M{"recipient": r.Email, "month": month}).Count()
+	if err != nil || n > 0 {
+		return err
+	}
+	report, err := buildIncomeReport(session, r, now)
+	if err != nil {
+		return err
+	}
+	if len(report.Lines) == 0 && report.Missing == "" {
+		return nil
+	}
+	report.Date = time.Now()
+	report.Status = StatusPending
+	report.NextAttempt = now
+	if err = collection.Insert(report); err != nil && !mgo.IsDup(err) {
+		return err
+	}
+	return nil
+}
+
+func listRecipients() error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	var recipients []Recipient
+	err = session.DB(dbName).C(recipientsCollName).Find(nil).Sort("_id").All(&recipients)
+	if err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		fmt.Println(r.Email)
+		if len(r.Rules) > 0 {
+			fmt.Printf("\trules: %s\n", strings.Join(r.Rules, ", "))
+		}
+		for _, holding := range r.Holdings {
+			fmt.Printf("\t%s\t%d\n", holding.Ticker, holding.Quotas)
 		}
-		collection := notificationsCollection(session)
-		collection.Insert(Notification{NewsID: news.ID, Recipient: recipient, Date: time.Now()})
+	}
+	return nil
+}
+
+// removeRecipient removes the recipient, along with its watermark and the
+// notifications and income reports that weren't delivered to it, so they're
+// not retried. Delivered notifications are kept, so news aren't sent again if
+// the recipient is added back.
+func removeRecipient(session *mgo.Session, email string) error {
+	err := session.DB(dbName).C(recipientsCollName).RemoveId(email)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("recipient not found: %s", email)
+	} else if err != nil {
+		return err
+	}
+	undelivered := bson.M{
+		"recipient": email,
+		"status":    bson.M{"$in": []string{StatusPending, StatusSending, StatusFailed, StatusDead}},
+	}
+	if _, err = notificationsCollection(session).RemoveAll(undelivered); err != nil {
+		return err
+	}
+	if _, err = session.DB(dbName).C(incomeReportsCollName).RemoveAll(undelivered); err != nil {
+		return err
+	}
+	err = session.DB(dbName).C(watermarksCollName).RemoveId(email)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func updateRecipient(email string, update func(*Recipient) error) error {
+	session, err := connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	collection := session.DB(dbName).C(recipientsCollName)
+	var r Recipient
+	err = collection.FindId(email).One(&r)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("recipient not found: %s", email)
+	} else if err != nil {
+		return err
+	}
+	if err = update(&r); err != nil {
+		return err
+	}
+	sort.Sort(holdingsByTicker(r.Holdings))
+	return collection.UpdateId(email, bson.M{"$set": bson.M{"holdings": r.Holdings, "rules": r.Rules}})
+}
+
+type holdingsByTicker []Holding
+
+func (h holdingsByTicker) Len() int           { return len(h) }
+func (h holdingsByTicker) Less(i, j int) bool { return h[i].Ticker < h[j].Ticker }
+func (h holdingsByTicker) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// command runs one of the commands for managing recipients and holdings.
+func command(args []string) error {
+	usage := map[string]string{
+		"recipients":       "recipients",
+		"add-recipient":    "add-recipient <email>",
+		"remove-recipient": "remove-recipient <email>",
+		"set-holding":      "set-holding <email> <ticker> [<quotas>]",
+		"remove-holding":   "remove-holding <email> <ticker>",
+		"set-rules":        "set-rules <email> [<rule>...]",
+		"failures":         "failures",
+		"requeue":          "requeue [<email> [<news id>|<month>]]",
+	}
+	name := args[0]
+	if _, ok := usage[name]; !ok {
+		return fmt.Errorf("unknown command: %q", name)
+	}
+	args = args[1:]
+	invalid := fmt.Errorf("usage: fii_report %s", usage[name])
+	switch name {
+	case "recipients":
+		return listRecipients()
+	case "failures":
+		return listFailures()
+	case "requeue":
+		if len(args) > 2 {
+			return invalid
+		}
+		return requeue(args)
+	case "add-recipient", "remove-recipient":
+		if len(args) != 1 {
+			return invalid
+		}
+		session, err := connect()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		collection := session.DB(dbName).C(recipientsCollName)
+		if name == "add-recipient" {
+			err = collection.Insert(Recipient{Email: args[0]})
+			if mgo.IsDup(err) {
+				return fmt.Errorf("recipient already exists: %s", args[0])
+			}
+			return err
+		}
+		return removeRecipient(session, args[0])
+	case "set-rules":
+		if len(args) < 1 {
+			return invalid
+		}
+		if err := loadRules(); err != nil {
+			return err
+		}
+		for _, name := range args[1:] {
+			if !ruleExists(name) {
+				return fmt.Errorf("unknown rule: %q", name)
+			}
+		}
+		return updateRecipient(args[0], func(r *Recipient) error {
+			r.Rules = args[1:]
+			return nil
+		})
+	case "set-holding":
+		if len(args) != 2 && len(args) != 3 {
+			return invalid
+		}
+		ticker := strings.ToUpper(args[1])
+		var quotas int
+		if len(args) == 3 {
+			var err error
+			if quotas, err = strconv.Atoi(args[2]); err != nil || quotas < 0 {
+				return fmt.Errorf("invalid number of quotas: %q", args[2])
+			}
+		}
+		return updateRecipient(args[0], func(r *Recipient) error {
+			for i := range r.Holdings {
+				if r.Holdings[i].Ticker == ticker {
+					r.Holdings[i].Quotas = quotas
+					return nil
+				}
+			}
+			r.Holdings = append(r.Holdings, Holding{Ticker: ticker, Quotas: quotas})
+			return nil
+		})
+	default:
+		if len(args) != 2 {
+			return invalid
+		}
+		ticker := strings.ToUpper(args[1])
+		return updateRecipient(args[0], func(r *Recipient) error {
+			for i := range r.Holdings {
+				if r.Holdings[i].Ticker == ticker {
+					r.Holdings = append(r.Holdings[:i], r.Holdings[i+1:]...)
+					return nil
+				}
+			}
+			return errors.New("holding not found: " + ticker)
+		})
 	}
 }
 
 func main() {
 	var failures int
 	flag.Parse()
+	if flag.NArg() > 0 {
+		if err := command(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if sender == "" {
 		log.Print("Please provide the sender")
 		failures++
 	}
-	if recipient == "" {
-		log.Print("Please provide the recipient")
-		failures++
-	}
 	if password == "" {
 		log.Print("Please provide the password")
 		failures++
@@ -173,8 +1448,20 @@ func main() {
 		log.Print("Please provide the base URL")
 		failures++
 	}
+	if err := loadRules(); err != nil {
+		log.Printf("Failed to load rules: %s", err)
+		failures++
+	}
 	if failures > 0 {
 		os.Exit(2)
 	}
+	if listenHTTP != "" {
+		http.Handle("/distributions", http.HandlerFunc(serveDistributions))
+		http.Handle("/yields", http.HandlerFunc(serveYields))
+		go poolQuotes(time.Tick(tickerTime))
+		go func() {
+			log.Fatal(http.ListenAndServe(listenHTTP, nil))
+		}()
+	}
 	poolRecords(time.Tick(tickerTime))
 }
@@ -0,0 +1,72 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import "time"
+
+// IsTradingDay checks whether B3 (formerly BM&FBovespa) is open in the day
+// of t, considering weekends and the holidays in the calendar of the
+// exchange. Ash Wednesday is a trading day, even though the session starts
+// later.
+func IsTradingDay(t time.Time) bool {
+	switch t.Weekday() {
+	case time.Saturday, time.Sunday:
+		return false
+	}
+	return !isHoliday(t.Year(), t.Month(), t.Day())
+}
+
+func isHoliday(year int, month time.Month, day int) bool {
+	switch {
+	case month == time.January && day == 1,
+		month == time.April && day == 21,
+		month == time.May && day == 1,
+		month == time.September && day == 7,
+		month == time.October && day == 12,
+		month == time.November && day == 2,
+		month == time.November && day == 15,
+		month == time.December && day == 24,
+		month == time.December && day == 25,
+		month == time.December && day == 31:
+		return true
+	case month == time.November && day == 20:
+		// Black Consciousness Day was a holiday in the city of São
+		// Paulo, where B3 closed until 2021, and is a national holiday
+		// since 2024.
+		return year <= 2021 || year >= 2024
+	case month == time.January && day == 25, month == time.July && day == 9:
+		// Holidays in the city and in the state of São Paulo. B3 opens
+		// on them since 2022.
+		return year <= 2021
+	}
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	easter := Easter(year)
+	for _, offset := range []int{-48, -47, -2, 60} { // Carnival, Good Friday and Corpus Christi.
+		if date.Equal(easter.AddDate(0, 0, offset)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Easter returns the date of Easter Sunday in the given year, in UTC, using
+// the anonymous Gregorian algorithm.
+func Easter(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
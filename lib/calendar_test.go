@@ -0,0 +1,55 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEaster(t *testing.T) {
+	var tests = []struct {
+		year     int
+		expected time.Time
+	}{
+		{2014, time.Date(2014, 4, 20, 0, 0, 0, 0, time.UTC)},
+		{2015, time.Date(2015, 4, 5, 0, 0, 0, 0, time.UTC)},
+		{2016, time.Date(2016, 3, 27, 0, 0, 0, 0, time.UTC)},
+		{2025, time.Date(2025, 4, 20, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := Easter(tt.year); !got.Equal(tt.expected) {
+			t.Errorf("Easter(%d): want %s, got %s", tt.year, tt.expected, got)
+		}
+	}
+}
+
+func TestIsTradingDay(t *testing.T) {
+	var tests = []struct {
+		date     time.Time
+		expected bool
+	}{
+		{time.Date(2015, 10, 19, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2015, 10, 17, 0, 0, 0, 0, time.UTC), false}, // Saturday
+		{time.Date(2015, 10, 18, 0, 0, 0, 0, time.UTC), false}, // Sunday
+		{time.Date(2015, 10, 12, 0, 0, 0, 0, time.UTC), false}, // Nossa Senhora Aparecida
+		{time.Date(2015, 2, 16, 0, 0, 0, 0, time.UTC), false},  // Carnival
+		{time.Date(2015, 2, 17, 0, 0, 0, 0, time.UTC), false},  // Carnival
+		{time.Date(2015, 2, 18, 0, 0, 0, 0, time.UTC), true},   // Ash Wednesday
+		{time.Date(2015, 4, 3, 0, 0, 0, 0, time.UTC), false},   // Good Friday
+		{time.Date(2015, 6, 4, 0, 0, 0, 0, time.UTC), false},   // Corpus Christi
+		{time.Date(2015, 7, 9, 0, 0, 0, 0, time.UTC), false},   // Revolução Constitucionalista
+		{time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC), false}, // Consciência Negra
+		{time.Date(2015, 12, 31, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2023, 1, 25, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2023, 11, 20, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 11, 20, 0, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := IsTradingDay(tt.date); got != tt.expected {
+			t.Errorf("IsTradingDay(%s): want %v, got %v", tt.date.Format("2006-01-02"), tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	location, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Skip(err)
+	}
+	var tests = []struct {
+		spec     string
+		trading  bool
+		from     time.Time
+		expected time.Time
+	}{
+		{"* * * * *", false, time.Date(2015, 10, 19, 10, 0, 30, 0, location), time.Date(2015, 10, 19, 10, 1, 0, 0, location)},
+		{"*/5 8-19 * * 1-5", false, time.Date(2015, 10, 19, 10, 3, 0, 0, location), time.Date(2015, 10, 19, 10, 5, 0, 0, location)},
+		{"*/5 8-19 * * 1-5", false, time.Date(2015, 10, 19, 10, 5, 0, 0, location), time.Date(2015, 10, 19, 10, 10, 0, 0, location)},
+		{"*/5 8-19 * * 1-5", false, time.Date(2015, 10, 19, 19, 56, 0, 0, location), time.Date(2015, 10, 20, 8, 0, 0, 0, location)},
+		{"*/5 8-19 * * 1-5", false, time.Date(2015, 10, 23, 20, 0, 0, 0, location), time.Date(2015, 10, 26, 8, 0, 0, 0, location)},
+		{"0,30 9 * * *", false, time.Date(2015, 10, 19, 9, 0, 0, 0, location), time.Date(2015, 10, 19, 9, 30, 0, 0, location)},
+		{"0 0 1 * *", false, time.Date(2015, 10, 19, 9, 0, 0, 0, location), time.Date(2015, 11, 1, 0, 0, 0, 0, location)},
+		{"0 12 13 * 5", false, time.Date(2015, 10, 19, 9, 0, 0, 0, location), time.Date(2015, 10, 23, 12, 0, 0, 0, location)},
+		{"0 0 29 2 *", false, time.Date(2015, 3, 1, 0, 0, 0, 0, location), time.Date(2016, 2, 29, 0, 0, 0, 0, location)},
+		{"0 0 31 2 *", false, time.Date(2015, 3, 1, 0, 0, 0, 0, location), time.Time{}},
+		// 2015-10-12 is a holiday, and the next trading day is 2015-10-13.
+		{"*/5 8-19 * * 1-5", true, time.Date(2015, 10, 9, 19, 56, 0, 0, location), time.Date(2015, 10, 13, 8, 0, 0, 0, location)},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec, location)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %s", tt.spec, err)
+			continue
+		}
+		s.TradingDays = tt.trading
+		if got := s.Next(tt.from); !got.Equal(tt.expected) {
+			t.Errorf("Next(%q, %s): want %s, got %s", tt.spec, tt.from, tt.expected, got)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"a * * * *",
+	}
+	for _, spec := range specs {
+		if _, err := ParseSchedule(spec, time.UTC); err == nil {
+			t.Errorf("ParseSchedule(%q): want error, got nil", spec)
+		}
+	}
+}
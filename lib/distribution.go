@@ -0,0 +1,86 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"regexp"
+	"time"
+)
+
+// Distribution is an announcement of a distribution of income by a FII.
+type Distribution struct {
+	Ticker string
+
+	// Amount is the value distributed per quota, in BRL.
+	Amount float64
+
+	// DataCom is the last day in which the holders of the quotas are
+	// entitled to the distribution.
+	DataCom time.Time
+
+	PaymentDate time.Time
+}
+
+var (
+	distributionMention = regexp.MustCompile(`\b(rendimentos?|distribuicao|distribuira)\b`)
+	fiiTicker           = regexp.MustCompile(`\b[A-Z]{4}11B?\b`)
+	amountPerQuota      = regexp.MustCompile(`r\$\s*(\d{1,3}(?:\.\d{3})*,\d+)[^;]{0,40}?\bpor cota`)
+	amount              = regexp.MustCompile(`r\$\s*(\d{1,3}(?:\.\d{3})*,\d+)`)
+	dataComPatterns     = []*regexp.Regexp{
+		regexp.MustCompile(`\bdata[\s-]*(?:com|base)\b[^0-9]{0,60}(\d{2}/\d{2}/\d{4})`),
+		regexp.MustCompile(`\b(?:posicao|titulares de cotas|detentores de cotas)\b[^0-9]{0,60}(\d{2}/\d{2}/\d{4})`),
+	}
+	paymentPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\b(?:data (?:de|do) pagamento|pagamento)\b[^0-9]{0,60}(\d{2}/\d{2}/\d{4})`),
+		regexp.MustCompile(`\b(?:sera|serao) (?:pagos?|creditados?)\b[^0-9]{0,60}(\d{2}/\d{2}/\d{4})`),
+	}
+)
+
+// ParseDistribution extracts the distribution announced in the given text,
+// usually the body of a news. The value per quota is required, along with at
+// least one of the dates. The ticker is only filled when the text mentions
+// it.
+//
+// Dates are in the America/Sao_Paulo time zone.
+func ParseDistribution(text string) (Distribution, bool) {
+	var d Distribution
+	folded := Fold(text)
+	if !distributionMention.MatchString(folded) {
+		return d, false
+	}
+	parts := amountPerQuota.FindStringSubmatch(folded)
+	if parts == nil {
+		if all := amount.FindAllStringSubmatch(folded, 2); len(all) == 1 {
+			parts = all[0]
+		}
+	}
+	if parts == nil {
+		return d, false
+	}
+	value, err := parseDecimal(parts[1])
+	if err != nil || value <= 0 {
+		return d, false
+	}
+	d.Amount = value
+	d.DataCom = findDate(folded, dataComPatterns)
+	d.PaymentDate = findDate(folded, paymentPatterns)
+	if d.DataCom.IsZero() && d.PaymentDate.IsZero() {
+		return d, false
+	}
+	d.Ticker = fiiTicker.FindString(text)
+	return d, true
+}
+
+func findDate(text string, patterns []*regexp.Regexp) time.Time {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	for _, pattern := range patterns {
+		if parts := pattern.FindStringSubmatch(text); parts != nil {
+			if date, err := time.ParseInLocation("02/01/2006", parts[1], location); err == nil {
+				return date
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDistribution(t *testing.T) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, location)
+	}
+	var tests = []struct {
+		text     string
+		expected Distribution
+		ok       bool
+	}{
+		{
+			"O CSHG LOGÍSTICA FII (HGLG11) comunica que distribuirá rendimentos no valor de R$ 0,78 por cota aos detentores de cotas em 27/02/2015. O pagamento será realizado em 13/03/2015.",
+			Distribution{Ticker: "HGLG11", Amount: 0.78, DataCom: date(2015, 2, 27), PaymentDate: date(2015, 3, 13)},
+			true,
+		},
+		{
+			"Distribuição de Rendimentos\nValor por cota: R$ 1.050,25\nData-base: 30/01/2015\nData de pagamento: 10/02/2015",
+			Distribution{Amount: 1050.25, DataCom: date(2015, 1, 30), PaymentDate: date(2015, 2, 10)},
+			true,
+		},
+		{
+			"Os rendimentos de R$ 0,55 (cinquenta e cinco centavos) por cota do KNRI11 serão pagos em 15/04/2015.",
+			Distribution{Ticker: "KNRI11", Amount: 0.55, PaymentDate: date(2015, 4, 15)},
+			true,
+		},
+		{
+			"O fundo informa que o relatório gerencial de março está disponível.",
+			Distribution{},
+			false,
+		},
+		{
+			"Distribuição de rendimentos de R$ 0,60 por cota, em data a ser definida.",
+			Distribution{},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := ParseDistribution(tt.text)
+		if ok != tt.ok {
+			t.Errorf("ParseDistribution(%q): want ok=%v, got %v", tt.text, tt.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got.Ticker != tt.expected.Ticker || got.Amount != tt.expected.Amount ||
+			!got.DataCom.Equal(tt.expected.DataCom) || !got.PaymentDate.Equal(tt.expected.PaymentDate) {
+			t.Errorf("ParseDistribution(%q): want %#v, got %#v", tt.text, tt.expected, got)
+		}
+	}
+}
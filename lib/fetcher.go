@@ -0,0 +1,191 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const DefaultUserAgent = "inv_bots (+https://github.com/fsouza/inv_bots)"
+
+var metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset=["']?([\w-]+)`)
+
+// StatusError is returned by the Fetcher when the server responds with a
+// status other than 200.
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status downloading %s: %d", e.URL, e.StatusCode)
+}
+
+// Fetcher downloads pages, retrying failed requests and limiting the rate of
+// requests. Pages are always returned in UTF-8.
+//
+// The fields of the Fetcher must not be changed after the first call to
+// Fetch. It's safe to use the same Fetcher from multiple goroutines.
+type Fetcher struct {
+	Client    *http.Client
+	UserAgent string
+
+	// Retries is the number of times a request is retried, in case of
+	// network errors or server errors (5xx).
+	Retries int
+
+	// Backoff is the time to wait before the first retry. It doubles on
+	// every retry.
+	Backoff time.Duration
+
+	// Interval is the minimum interval between two requests.
+	Interval time.Duration
+
+	requests int64
+	retries  int64
+	failures int64
+	last     time.Time
+	mutex    sync.Mutex
+}
+
+// FetcherStats contains the number of requests made by a Fetcher since it was
+// created. Retries are also counted as requests, and Failures is the number
+// of calls to Fetch that returned an error.
+type FetcherStats struct {
+	Requests int64
+	Retries  int64
+	Failures int64
+}
+
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		Client:    &http.Client{Timeout: 30 * time.Second},
+		UserAgent: DefaultUserAgent,
+		Retries:   3,
+		Backoff:   time.Second,
+		Interval:  500 * time.Millisecond,
+	}
+}
+
+// Fetch downloads the given URL, returning the body of the response.
+func (f *Fetcher) Fetch(url string) ([]byte, error) {
+	backoff := f.Backoff
+	for i := 0; ; i++ {
+		atomic.AddInt64(&f.requests, 1)
+		content, err := f.fetch(url)
+		if err == nil {
+			return content, nil
+		}
+		if i >= f.Retries || !temporary(err) {
+			atomic.AddInt64(&f.failures, 1)
+			return nil, err
+		}
+		atomic.AddInt64(&f.retries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (f *Fetcher) Stats() FetcherStats {
+	return FetcherStats{
+		Requests: atomic.LoadInt64(&f.requests),
+		Retries:  atomic.LoadInt64(&f.retries),
+		Failures: atomic.LoadInt64(&f.failures),
+	}
+}
+
+func (f *Fetcher) fetch(url string) ([]byte, error) {
+	f.wait()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.UserAgent)
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ToUTF8(content, resp.Header.Get("Content-Type")), nil
+}
+
+// wait blocks until the next request is allowed.
+func (f *Fetcher) wait() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if next := f.last.Add(f.Interval); time.Now().Before(next) {
+		time.Sleep(next.Sub(time.Now()))
+	}
+	f.last = time.Now()
+}
+
+func temporary(err error) bool {
+	if e, ok := err.(*StatusError); ok {
+		return e.StatusCode >= 500
+	}
+	return true
+}
+
+// ToUTF8 converts the content to UTF-8, using the charset declared in the
+// given Content-Type or in the HTML. Content in ISO-8859-1 and Windows-1252 is
+// converted, anything else is assumed to be UTF-8, unless it's not valid
+// UTF-8, in which case it's handled as Windows-1252.
+func ToUTF8(content []byte, contentType string) []byte {
+	var charset string
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		charset = params["charset"]
+	}
+	if charset == "" {
+		if parts := metaCharset.FindSubmatch(content); len(parts) > 1 {
+			charset = string(parts[1])
+		}
+	}
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		return decodeWindows1252(content)
+	}
+	if !utf8.Valid(content) {
+		return decodeWindows1252(content)
+	}
+	return content
+}
+
+// windows1252 maps the bytes from 0x80 to 0x9f to the characters they
+// represent in Windows-1252. ISO-8859-1 only has control characters in this
+// range, so Windows-1252 is a safe superset.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(content []byte) []byte {
+	result := make([]byte, 0, len(content))
+	var buf [utf8.UTFMax]byte
+	for _, b := range content {
+		r := rune(b)
+		if b >= 0x80 && b <= 0x9f {
+			r = windows1252[b-0x80]
+		}
+		n := utf8.EncodeRune(buf[:], r)
+		result = append(result, buf[:n]...)
+	}
+	return result
+}
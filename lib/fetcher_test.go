@@ -0,0 +1,136 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestToUTF8(t *testing.T) {
+	var tests = []struct {
+		content     string
+		contentType string
+		expected    string
+	}{
+		{"Relat\xf3rio", "text/html; charset=iso-8859-1", "Relatório"},
+		{"Relat\xf3rio", "text/html; charset=ISO-8859-1", "Relatório"},
+		{"\x93aspas\x94", "text/html; charset=windows-1252", "“aspas”"},
+		{`<meta charset="iso-8859-1">Relat` + "\xf3rio", "text/html", `<meta charset="iso-8859-1">Relatório`},
+		{"Relat\xf3rio", "", "Relatório"},
+		{"Relatório", "text/html; charset=utf-8", "Relatório"},
+		{"Relatório", "", "Relatório"},
+	}
+	for _, tt := range tests {
+		got := string(ToUTF8([]byte(tt.content), tt.contentType))
+		if got != tt.expected {
+			t.Errorf("ToUTF8(%q, %q): want %q, got %q", tt.content, tt.contentType, tt.expected, got)
+		}
+	}
+}
+
+func newTestFetcher() *Fetcher {
+	fetcher := NewFetcher()
+	fetcher.Backoff = time.Millisecond
+	fetcher.Interval = 0
+	return fetcher
+}
+
+func TestFetchRetriesServerErrors(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+	fetcher := newTestFetcher()
+	content, err := fetcher.Fetch(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "ok" {
+		t.Errorf("Fetch: want %q, got %q", "ok", content)
+	}
+	expected := FetcherStats{Requests: 3, Retries: 2}
+	if stats := fetcher.Stats(); stats != expected {
+		t.Errorf("Stats: want %#v, got %#v", expected, stats)
+	}
+}
+
+func TestFetchGivesUpAfterRetries(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	fetcher := newTestFetcher()
+	fetcher.Retries = 2
+	_, err := fetcher.Fetch(server.URL)
+	if e, ok := err.(*StatusError); !ok || e.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Fetch: want StatusError with status 500, got %#v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Fetch: want 3 calls, got %d", calls)
+	}
+	if stats := fetcher.Stats(); stats.Failures != 1 {
+		t.Errorf("Stats: want 1 failure, got %d", stats.Failures)
+	}
+}
+
+func TestFetchDoesNotRetryClientErrors(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	_, err := newTestFetcher().Fetch(server.URL)
+	if err == nil {
+		t.Fatal("Fetch: want error, got nil")
+	}
+	if calls != 1 {
+		t.Errorf("Fetch: want 1 call, got %d", calls)
+	}
+}
+
+func TestFetchUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+	}))
+	defer server.Close()
+	fetcher := newTestFetcher()
+	fetcher.UserAgent = "test-agent"
+	if _, err := fetcher.Fetch(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if userAgent != "test-agent" {
+		t.Errorf("Fetch: want user agent %q, got %q", "test-agent", userAgent)
+	}
+}
+
+func TestFetchInterval(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	fetcher := newTestFetcher()
+	fetcher.Interval = 50 * time.Millisecond
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := fetcher.Fetch(server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Fetch: want at least 100ms for 3 requests, got %s", elapsed)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"launchpad.net/xmlpath"
+)
+
+var (
+	pathPlantaoLink = xmlpath.MustCompile(`//ul[@id="linksNoticias"]/li/a`)
+	pathPlantaoHref = xmlpath.MustCompile("./@href")
+	plantaoIDRegexp = regexp.MustCompile(`^ListarNoticias.aspx\?idioma=pt-br\&idNoticia=(\d+)\&.*$`)
+)
+
+// PlantaoSanitizers fixes the HTML of the listing of "Plantão Empresas",
+// which contains unescaped comparison operators in the text of the news. The
+// operators are escaped, so they're kept in the titles.
+var PlantaoSanitizers = []Sanitizer{
+	Replace(" < ", " &lt; "),
+	Replace(" > ", " &gt; "),
+	Replace(" <= ", " &lt;= "),
+	Replace(" >= ", " &gt;= "),
+}
+
+// PlantaoItem is an item in the listing of "Plantão Empresas".
+type PlantaoItem struct {
+	ID    string
+	Title string
+	Date  time.Time
+}
+
+// PlantaoID extracts the ID of the news from the link in the listing.
+func PlantaoID(href string) (string, bool) {
+	parts := plantaoIDRegexp.FindStringSubmatch(href)
+	if len(parts) < 2 {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// ParsePlantao extracts the items from a page of the listing of "Plantão
+// Empresas". It returns false when the page doesn't contain the listing,
+// which happens after the last page. Items without ID or with invalid dates
+// are skipped.
+func ParsePlantao(node *xmlpath.Node) ([]PlantaoItem, bool) {
+	if !pathPlantaoLink.Exists(node) {
+		return nil, false
+	}
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	var items []PlantaoItem
+	iter := pathPlantaoLink.Iter(node)
+	for iter.Next() {
+		var item PlantaoItem
+		href, ok := pathPlantaoHref.String(iter.Node())
+		if !ok {
+			continue
+		}
+		if item.ID, ok = PlantaoID(href); !ok {
+			continue
+		}
+		content := strings.TrimSpace(iter.Node().String())
+		parts := strings.SplitN(content, " - ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		item.Title = parts[1]
+		date, err := time.ParseInLocation("02/01/2006 15:04", parts[0], location)
+		if err != nil {
+			continue
+		}
+		item.Date = date
+		items = append(items, item)
+	}
+	return items, true
+}
+
+const (
+	CategoryFII          = "fii"
+	CategoryDividend     = "dividend"
+	CategoryEarnings     = "earnings"
+	CategoryMeeting      = "meeting"
+	CategoryMaterialFact = "material-fact"
+	CategoryOther        = "other"
+)
+
+// categoryRules is the table used for categorizing news. Rules are checked in
+// order against the title, in lower case and without accents, and the first
+// match wins. News that don't match any rule are categorized as
+// CategoryOther.
+var categoryRules = []struct {
+	category string
+	regexp   *regexp.Regexp
+}{
+	{CategoryFII, regexp.MustCompile(`^fii\b`)},
+	{CategoryMaterialFact, regexp.MustCompile(`\bfato relevante\b`)},
+	{CategoryDividend, regexp.MustCompile(`\b(dividendos?|jcp|juros sobre (o )?capital( proprio)?|proventos?|rendimentos?)\b`)},
+	{CategoryEarnings, regexp.MustCompile(`\b(resultados?|release|itr|dfp|demonstracoes financeiras|informacoes trimestrais)\b`)},
+	{CategoryMeeting, regexp.MustCompile(`\b(assembleia|ago|age|agoe|edital de convocacao|convocacao)\b`)},
+}
+
+var (
+	tickerRegexp = regexp.MustCompile(`\b[A-Z]{4}(?:3|4|5|6|7|8|11)\b`)
+
+	// tickerInParens matches the code of the issuer in the title, like
+	// (PETR) or (BRCR11). Codes start with four letters, so years and
+	// periods, like (2015) or (1T15), are not taken as tickers.
+	tickerInParens = regexp.MustCompile(`\(([A-Z]{4}[A-Z0-9]{0,2})\)`)
+)
+
+// PlantaoTitle is the information extracted from the title of a news. Titles
+// usually look like "ISSUER (TICK) - Subject".
+type PlantaoTitle struct {
+	Issuer   string
+	Tickers  []string
+	Category string
+}
+
+// ParsePlantaoTitle extracts the issuer, the tickers and the category of the
+// news from its title. Besides the full codes, the root of each ticker is also
+// included (e.g. PETR for PETR4), so news mentioning only the root are found
+// by the full code.
+func ParsePlantaoTitle(title string) PlantaoTitle {
+	var parsed PlantaoTitle
+	seen := make(map[string]bool)
+	addTicker := func(ticker string) {
+		if !seen[ticker] {
+			seen[ticker] = true
+			parsed.Tickers = append(parsed.Tickers, ticker)
+		}
+	}
+	for _, parts := range tickerInParens.FindAllStringSubmatch(title, -1) {
+		addTicker(parts[1])
+	}
+	for _, ticker := range tickerRegexp.FindAllString(title, -1) {
+		addTicker(ticker)
+	}
+	for _, ticker := range parsed.Tickers {
+		if len(ticker) > 4 {
+			addTicker(ticker[:4])
+		}
+	}
+	if parts := strings.SplitN(title, " - ", 2); len(parts) == 2 {
+		issuer := tickerInParens.ReplaceAllString(parts[0], "")
+		parsed.Issuer = strings.Join(strings.Fields(issuer), " ")
+	}
+	parsed.Category = Categorize(title)
+	return parsed
+}
+
+// Categorize returns the category of the news with the given title (see
+// categoryRules).
+func Categorize(title string) string {
+	title = Fold(title)
+	for _, rule := range categoryRules {
+		if rule.regexp.MatchString(title) {
+			return rule.category
+		}
+	}
+	return CategoryOther
+}
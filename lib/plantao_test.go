@@ -0,0 +1,191 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// parseFixture parses a page in testdata. The fixtures are synthetic: they're
+// written after the markup of the listing of "Plantão Empresas", trimmed to a
+// few items, including one with an unescaped comparison operator, and aren't
+// recorded from the site.
+func parseFixture(t *testing.T, name string) ([]PlantaoItem, bool) {
+	content, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := ParseHTML(content, PlantaoSanitizers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ParsePlantao(node)
+}
+
+func TestPlantaoID(t *testing.T) {
+	var tests = []struct {
+		href string
+		id   string
+		ok   bool
+	}{
+		{"ListarNoticias.aspx?idioma=pt-br&idNoticia=532911&tipoFiltro=0&pg=1", "532911", true},
+		{"ListarNoticias.aspx?idioma=pt-br&idNoticia=1&pg=2", "1", true},
+		{"ListarNoticias.aspx?idioma=pt-br&idNoticia=532911", "", false},
+		{"ListarNoticias.aspx?idioma=en-us&idNoticia=532911&pg=1", "", false},
+		{"javascript:void(0)", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := PlantaoID(tt.href)
+		if id != tt.id || ok != tt.ok {
+			t.Errorf("PlantaoID(%q): want (%q, %v), got (%q, %v)", tt.href, tt.id, tt.ok, id, ok)
+		}
+	}
+}
+
+func TestParsePlantao(t *testing.T) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	items, ok := parseFixture(t, "plantao_page.html")
+	if !ok {
+		t.Fatal("ParsePlantao: want ok, got not ok")
+	}
+	expected := []PlantaoItem{
+		{ID: "532911", Title: "PETROBRAS (PETR) - Fato Relevante", Date: time.Date(2015, 10, 19, 18, 42, 0, 0, location)},
+		{ID: "532908", Title: "FII BC FUND (BRCR) - Relatório Gerencial", Date: time.Date(2015, 10, 19, 18, 30, 0, 0, location)},
+		{ID: "532907", Title: "ITAUUNIBANCO (ITUB) - Índice de Basileia < 11%", Date: time.Date(2015, 10, 19, 18, 21, 0, 0, location)},
+		{ID: "532905", Title: "VALE (VALE) - Edital de Convocação AGE", Date: time.Date(2015, 10, 19, 17, 55, 0, 0, location)},
+	}
+	if len(items) != len(expected) {
+		t.Fatalf("ParsePlantao: want %d items, got %d: %#v", len(expected), len(items), items)
+	}
+	for i := range expected {
+		if items[i].ID != expected[i].ID || items[i].Title != expected[i].Title || !items[i].Date.Equal(expected[i].Date) {
+			t.Errorf("ParsePlantao: item %d\nwant %#v\ngot  %#v", i, expected[i], items[i])
+		}
+	}
+}
+
+func TestParsePlantaoLastPage(t *testing.T) {
+	items, ok := parseFixture(t, "plantao_last_page.html")
+	if ok {
+		t.Error("ParsePlantao: want not ok, got ok")
+	}
+	if len(items) != 0 {
+		t.Errorf("ParsePlantao: want no items, got %#v", items)
+	}
+}
+
+func TestParsePlantaoTitle(t *testing.T) {
+	var tests = []struct {
+		title    string
+		expected PlantaoTitle
+	}{
+		{
+			"PETROBRAS (PETR) - Fato Relevante",
+			PlantaoTitle{Issuer: "PETROBRAS", Tickers: []string{"PETR"}, Category: CategoryMaterialFact},
+		},
+		{
+			"FII BC FUND (BRCR) - Rendimento",
+			PlantaoTitle{Issuer: "FII BC FUND", Tickers: []string{"BRCR"}, Category: CategoryFII},
+		},
+		{
+			"ITAUUNIBANCO (ITUB) - Pagamento de JCP - ITUB3 e ITUB4",
+			PlantaoTitle{Issuer: "ITAUUNIBANCO", Tickers: []string{"ITUB", "ITUB3", "ITUB4"}, Category: CategoryDividend},
+		},
+		{
+			"BRASKEM (BRKM5) - Resultados do 3T15",
+			PlantaoTitle{Issuer: "BRASKEM", Tickers: []string{"BRKM5", "BRKM"}, Category: CategoryEarnings},
+		},
+		{
+			"VALE (VALE) - Edital de Convocação AGE",
+			PlantaoTitle{Issuer: "VALE", Tickers: []string{"VALE"}, Category: CategoryMeeting},
+		},
+		{
+			"GERDAU (GGBR) - Informações Trimestrais (1T15)",
+			PlantaoTitle{Issuer: "GERDAU", Tickers: []string{"GGBR"}, Category: CategoryEarnings},
+		},
+		{
+			"CETIP (CTIP) - Calendário de Eventos (2015)",
+			PlantaoTitle{Issuer: "CETIP", Tickers: []string{"CTIP"}, Category: CategoryOther},
+		},
+		{
+			"Comunicado ao Mercado",
+			PlantaoTitle{Category: CategoryOther},
+		},
+	}
+	for _, tt := range tests {
+		got := ParsePlantaoTitle(tt.title)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("ParsePlantaoTitle(%q):\nwant %#v\ngot  %#v", tt.title, tt.expected, got)
+		}
+	}
+}
+
+func TestCategorize(t *testing.T) {
+	var tests = []struct {
+		title    string
+		expected string
+	}{
+		{"FII BC FUND (BRCR) - Fato Relevante", CategoryFII},
+		{"Fii Kinea (KNRI) - Rendimento", CategoryFII},
+		{"PETROBRAS (PETR) - Fato Relevante sobre Dividendos", CategoryMaterialFact},
+		{"AMBEV (ABEV) - Dividendos", CategoryDividend},
+		{"AMBEV (ABEV) - Juros sobre o Capital Próprio", CategoryDividend},
+		{"AMBEV (ABEV) - Aviso aos Acionistas - Proventos", CategoryDividend},
+		{"VALE (VALE) - Demonstrações Financeiras", CategoryEarnings},
+		{"VALE (VALE) - ITR", CategoryEarnings},
+		{"VALE (VALE) - Release de Resultados", CategoryEarnings},
+		{"VALE (VALE) - Assembleia Geral Ordinária", CategoryMeeting},
+		{"VALE (VALE) - AGO/E", CategoryMeeting},
+		{"VALE (VALE) - Alteração de Endereço", CategoryOther},
+		{"FIIS - Comunicado", CategoryOther},
+	}
+	for _, tt := range tests {
+		if got := Categorize(tt.title); got != tt.expected {
+			t.Errorf("Categorize(%q): want %q, got %q", tt.title, tt.expected, got)
+		}
+	}
+}
+
+// TestParsePlantaoRecordedResponse parses a real page of the listing, recorded
+// with the Replayer. No page is recorded in the repository yet, so the test is
+// skipped unless it's recorded with:
+//
+//	RECORD=1 go test -run TestParsePlantaoRecordedResponse
+func TestParsePlantaoRecordedResponse(t *testing.T) {
+	replayer := &Replayer{Dir: "testdata/http", Record: os.Getenv("RECORD") != ""}
+	url := "http://www.bmfbovespa.com.br/Agencia-Noticias/ListarNoticias.aspx?idioma=pt-br&q=&tipoFiltro=0&pg=1"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(replayer.RecordingPath(req)); os.IsNotExist(err) && !replayer.Record {
+		t.Skip("no recorded page of the listing")
+	}
+	fetcher := NewFetcher()
+	fetcher.Interval = 0
+	fetcher.Client.Transport = replayer
+	content, err := fetcher.Fetch(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := ParseHTML(content, PlantaoSanitizers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, ok := ParsePlantao(node)
+	if !ok || len(items) == 0 {
+		t.Fatal("ParsePlantao: want items in the recorded page, got none")
+	}
+	for _, item := range items {
+		if item.ID == "" || item.Title == "" || item.Date.IsZero() {
+			t.Errorf("ParsePlantao: incomplete item %#v", item)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// QuoteURL is the endpoint of BM&FBovespa that returns the quotes of a
+// ticker, in XML format.
+const QuoteURL = "http://www.bmfbovespa.com.br/Pregao-Online/ExecutaAcaoAjax.asp?CodigoPapel="
+
+type quotes struct {
+	Papeis []struct {
+		Codigo string `xml:",attr"`
+		Ultimo string `xml:",attr"`
+	} `xml:"Papel"`
+}
+
+// Quote returns the last price of the given ticker.
+func (f *Fetcher) Quote(ticker string) (float64, error) {
+	content, err := f.Fetch(QuoteURL + ticker)
+	if err != nil {
+		return 0, err
+	}
+	return ParseQuote(content, ticker)
+}
+
+// ParseQuote extracts the last price of the given ticker from the response
+// of the quote endpoint.
+func ParseQuote(content []byte, ticker string) (float64, error) {
+	var q quotes
+	// The endpoint declares the encoding of the response, which was already
+	// converted to UTF-8.
+	decoder := xml.NewDecoder(strings.NewReader(string(content)))
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := decoder.Decode(&q); err != nil {
+		return 0, err
+	}
+	for _, papel := range q.Papeis {
+		if strings.EqualFold(papel.Codigo, ticker) {
+			price, err := parseDecimal(papel.Ultimo)
+			if err != nil {
+				return 0, fmt.Errorf("invalid quote for %s: %q", ticker, papel.Ultimo)
+			}
+			return price, nil
+		}
+	}
+	return 0, fmt.Errorf("quote not found: %s", ticker)
+}
+
+// parseDecimal parses numbers in the Brazilian format (1.234,56). Numbers
+// without a comma are parsed as usual.
+func parseDecimal(value string) (float64, error) {
+	if strings.Contains(value, ",") {
+		value = strings.Replace(strings.Replace(value, ".", "", -1), ",", ".", 1)
+	}
+	return strconv.ParseFloat(value, 64)
+}
@@ -0,0 +1,22 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import "testing"
+
+func TestParseQuote(t *testing.T) {
+	content := []byte(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<ComportamentoPapeis><Papel Codigo="HGLG11" Nome="CSHG LOG" Ibovespa="" Data="19/10/2015 17:08:00" Abertura="1.150,00" Minimo="1.140,00" Maximo="1.155,00" Medio="1.148,31" Ultimo="1.151,50" Oscilacao="0,13"/></ComportamentoPapeis>`)
+	price, err := ParseQuote(content, "hglg11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price != 1151.5 {
+		t.Errorf("ParseQuote: want 1151.5, got %v", price)
+	}
+	if _, err = ParseQuote(content, "KNRI11"); err == nil {
+		t.Error("ParseQuote: want error for missing ticker, got nil")
+	}
+}
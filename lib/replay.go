@@ -0,0 +1,79 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+)
+
+// Replayer is an http.RoundTripper that replays responses recorded in files,
+// so scrapers can be tested offline, against real pages. Each response is
+// stored in Dir, in a file named after the method and URL of the request.
+//
+// When Record is true, requests are sent using Transport (or
+// http.DefaultTransport) and the responses are saved, replacing any previous
+// recording. Otherwise, requests without a recording fail.
+//
+// Example, for recording the responses used by a test:
+//
+//	fetcher := NewFetcher()
+//	fetcher.Client.Transport = &Replayer{Dir: "testdata/http", Record: os.Getenv("RECORD") != ""}
+type Replayer struct {
+	Dir       string
+	Record    bool
+	Transport http.RoundTripper
+}
+
+// RecordingPath returns the path of the file where the response to the given
+// request is stored.
+func (r *Replayer) RecordingPath(req *http.Request) string {
+	hash := sha1.Sum([]byte(req.Method + " " + req.URL.String()))
+	return filepath.Join(r.Dir, fmt.Sprintf("%x.http", hash))
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := r.RecordingPath(req)
+	if r.Record {
+		return r.record(req, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recording for %s %s (%s)", req.Method, req.URL, path)
+	} else if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+}
+
+func (r *Replayer) record(req *http.Request, path string) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := httputil.DumpResponse(resp, true)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(r.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestReplayerRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	defer server.Close()
+	recorder := &http.Client{Transport: &Replayer{Dir: dir, Record: true}}
+	replayer := &http.Client{Transport: &Replayer{Dir: dir}}
+	for _, client := range []*http.Client{recorder, replayer} {
+		resp, err := client.Get(server.URL + "/page")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "path=/page" {
+			t.Errorf("want body %q, got %q", "path=/page", body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("want Content-Type %q, got %q", "text/plain", ct)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("want 1 call to the server, got %d", calls)
+	}
+}
+
+func TestReplayerMissingRecording(t *testing.T) {
+	client := &http.Client{Transport: &Replayer{Dir: "testdata/http"}}
+	_, err := client.Get("http://localhost/not-recorded")
+	if err == nil {
+		t.Error("want error for missing recording, got nil")
+	}
+}
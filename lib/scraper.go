@@ -0,0 +1,64 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+
+	"launchpad.net/xmlpath"
+)
+
+// Sanitizer fixes broken HTML before it's parsed.
+type Sanitizer func([]byte) []byte
+
+// Replace returns a Sanitizer that replaces all occurrences of old with new.
+func Replace(old, new string) Sanitizer {
+	o, n := []byte(old), []byte(new)
+	return func(content []byte) []byte {
+		return bytes.Replace(content, o, n, -1)
+	}
+}
+
+// ParseHTML applies the sanitizers to the content, in order, and parses the
+// result.
+func ParseHTML(content []byte, sanitizers ...Sanitizer) (*xmlpath.Node, error) {
+	for _, sanitize := range sanitizers {
+		content = sanitize(content)
+	}
+	return xmlpath.ParseHTML(bytes.NewReader(content))
+}
+
+// Scraper is implemented by bots that collect data from HTML pages. The
+// Scraper is driven by Fetcher.Scrape, which downloads and parses each page.
+type Scraper interface {
+	// URL returns the URL of the given page. Pages start at 1.
+	URL(page int) string
+
+	// Sanitizers returns the fixes applied to each page before parsing it.
+	Sanitizers() []Sanitizer
+
+	// Scrape extracts data from the parsed page, returning whether the next
+	// page should be scraped.
+	Scrape(page int, node *xmlpath.Node) (bool, error)
+}
+
+// Scrape runs the scraper, page by page, until the scraper reports that there
+// are no more pages or an error happens.
+func (f *Fetcher) Scrape(s Scraper) error {
+	for page := 1; ; page++ {
+		content, err := f.Fetch(s.URL(page))
+		if err != nil {
+			return err
+		}
+		node, err := ParseHTML(content, s.Sanitizers()...)
+		if err != nil {
+			return err
+		}
+		more, err := s.Scrape(page, node)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
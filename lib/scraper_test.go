@@ -0,0 +1,43 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"testing"
+
+	"launchpad.net/xmlpath"
+)
+
+func TestReplace(t *testing.T) {
+	sanitize := Replace(" < ", " &lt; ")
+	got := string(sanitize([]byte("<p>1 < 2 < 3</p>")))
+	expected := "<p>1 &lt; 2 &lt; 3</p>"
+	if got != expected {
+		t.Errorf("Replace: want %q, got %q", expected, got)
+	}
+}
+
+func TestPlantaoSanitizers(t *testing.T) {
+	content := []byte("a < b > c <= d >= e<f")
+	for _, sanitize := range PlantaoSanitizers {
+		content = sanitize(content)
+	}
+	expected := "a &lt; b &gt; c &lt;= d &gt;= e<f"
+	if string(content) != expected {
+		t.Errorf("PlantaoSanitizers: want %q, got %q", expected, content)
+	}
+}
+
+func TestParseHTMLAppliesSanitizersInOrder(t *testing.T) {
+	content := []byte(`<html><body><p id="x">PRICE</p></body></html>`)
+	node, err := ParseHTML(content, Replace("PRICE", "1 < 2"), Replace(" < ", " &lt; "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := xmlpath.MustCompile(`//p[@id="x"]`).String(node)
+	if !ok || got != "1 < 2" {
+		t.Errorf("ParseHTML: want %q, got %q (ok=%v)", "1 < 2", got, ok)
+	}
+}
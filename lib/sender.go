@@ -8,7 +8,8 @@ import (
 )
 
 // GmailSender sends email using Gmail's SMTP server, reusing the underlying
-// SMTP connection.
+// SMTP connection. The connection is discarded whenever sending fails, so the
+// next message is sent using a new connection.
 type GmailSender struct {
 	conn     *smtp.Client
 	user     string
@@ -21,20 +22,31 @@ func NewGmailSender(user, password string) (*GmailSender, error) {
 }
 
 func (s *GmailSender) connect() error {
-	var err error
-	s.conn, err = smtp.Dial("smtp.gmail.com:587")
+	conn, err := smtp.Dial("smtp.gmail.com:587")
 	if err != nil {
 		return err
 	}
-	err = s.conn.Hello("localhost")
-	if err != nil {
-		return err
+	err = conn.Hello("localhost")
+	if err == nil {
+		err = conn.StartTLS(&tls.Config{ServerName: "smtp.gmail.com"})
+	}
+	if err == nil {
+		err = conn.Auth(smtp.PlainAuth("", s.user, s.password, "smtp.gmail.com"))
 	}
-	err = s.conn.StartTLS(&tls.Config{ServerName: "smtp.gmail.com"})
 	if err != nil {
+		conn.Close()
 		return err
 	}
-	return s.conn.Auth(smtp.PlainAuth("", s.user, s.password, "smtp.gmail.com"))
+	s.conn = conn
+	return nil
+}
+
+// reset discards the current connection.
+func (s *GmailSender) reset() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
 }
 
 func (s *GmailSender) SendMail(recipient string, data []byte) error {
@@ -46,11 +58,22 @@ func (s *GmailSender) SendMail(recipient string, data []byte) error {
 			return err
 		}
 	}
+	err := s.sendMail(recipient, data)
+	if err != nil {
+		s.reset()
+	}
+	return err
+}
+
+func (s *GmailSender) sendMail(recipient string, data []byte) error {
 	err := s.conn.Mail(s.user)
 	if err != nil {
 		return err
 	}
 	err = s.conn.Rcpt(recipient)
+	if err != nil {
+		return err
+	}
 	writer, err := s.conn.Data()
 	if err != nil {
 		return err
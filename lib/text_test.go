@@ -0,0 +1,24 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import "testing"
+
+func TestFold(t *testing.T) {
+	var tests = []struct {
+		text     string
+		expected string
+	}{
+		{"Relatório Gerencial", "relatorio gerencial"},
+		{"RELATÓRIO", "relatorio"},
+		{"Distribuição de Rendimentos", "distribuicao de rendimentos"},
+		{"FII CSHG LOG (HGLG) - Informe Mensal", "fii cshg log (hglg) - informe mensal"},
+	}
+	for _, tt := range tests {
+		if got := Fold(tt.text); got != tt.expected {
+			t.Errorf("Fold(%q): want %q, got %q", tt.text, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLease = 10 * 24 * time.Hour
+	MaxLease     = 30 * 24 * time.Hour
+)
+
+// Subscription is a WebSub subscription to a topic.
+type Subscription struct {
+	Callback string
+	Topic    string
+	Secret   string `bson:",omitempty"`
+	Expires  time.Time
+}
+
+// SubscriptionStore stores the subscriptions of a Hub.
+type SubscriptionStore interface {
+	// Save creates or updates the subscription, identified by its callback
+	// and topic.
+	Save(sub *Subscription) error
+
+	// Remove removes the subscription, if it exists.
+	Remove(sub *Subscription) error
+}
+
+// Hub is a WebSub hub, handling subscription and publishing requests. The
+// application defines which topics are valid and what happens when new
+// content is published, usually calling Deliver for each subscriber.
+//
+// Subscriptions are verified asynchronously, as defined by the WebSub
+// specification.
+type Hub struct {
+	Client *http.Client
+	Store  SubscriptionStore
+
+	// PublishSecret authenticates publishing requests, via the
+	// X-Hub-Publish-Secret header. Publishing is disabled when it's empty.
+	PublishSecret string
+
+	// ValidTopic checks whether the topic of the subscription request is
+	// served by the application.
+	ValidTopic func(r *http.Request, topic string) error
+
+	// Publish is called, in its own goroutine, for every authenticated
+	// publishing request.
+	Publish func()
+
+	// Verified, when not nil, is called after each subscription request is
+	// handled, with the error in the verification or in the store, if any.
+	Verified func(mode string, sub Subscription, err error)
+}
+
+func (h *Hub) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.FormValue("hub.mode")
+	switch mode {
+	case "publish":
+		if h.PublishSecret == "" || !hmac.Equal([]byte(r.Header.Get("X-Hub-Publish-Secret")), []byte(h.PublishSecret)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if h.Publish != nil {
+			go h.Publish()
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "subscribe", "unsubscribe":
+	default:
+		http.Error(w, fmt.Sprintf("invalid hub.mode: %q", mode), http.StatusBadRequest)
+		return
+	}
+	topic := r.FormValue("hub.topic")
+	if h.ValidTopic != nil {
+		if err := h.ValidTopic(r, topic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	callback, err := url.Parse(r.FormValue("hub.callback"))
+	if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+		http.Error(w, "invalid hub.callback", http.StatusBadRequest)
+		return
+	}
+	lease, err := ParseLease(r.FormValue("hub.lease_seconds"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret := r.FormValue("hub.secret")
+	if len(secret) > 200 {
+		http.Error(w, "invalid hub.secret", http.StatusBadRequest)
+		return
+	}
+	sub := Subscription{Callback: callback.String(), Topic: topic, Secret: secret}
+	go func() {
+		err := h.subscribe(mode, &sub, lease)
+		if h.Verified != nil {
+			h.Verified(mode, sub, err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Hub) subscribe(mode string, sub *Subscription, lease time.Duration) error {
+	if err := h.VerifyIntent(mode, sub, lease); err != nil {
+		return err
+	}
+	if mode == "unsubscribe" {
+		return h.Store.Remove(sub)
+	}
+	sub.Expires = time.Now().Add(lease)
+	return h.Store.Save(sub)
+}
+
+// ParseLease parses the lease requested by the subscriber, in seconds. An
+// empty value means DefaultLease, and leases are capped at MaxLease.
+func ParseLease(value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultLease, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 1 {
+		return 0, fmt.Errorf("invalid hub.lease_seconds: %q", value)
+	}
+	if seconds > int(MaxLease/time.Second) {
+		return MaxLease, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// VerifyIntent confirms the (un)subscription with the subscriber, that must
+// echo the challenge sent to the callback.
+func (h *Hub) VerifyIntent(mode string, sub *Subscription, lease time.Duration) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	challenge := hex.EncodeToString(b[:])
+	callback, err := url.Parse(sub.Callback)
+	if err != nil {
+		return err
+	}
+	query := callback.Query()
+	query.Set("hub.mode", mode)
+	query.Set("hub.topic", sub.Topic)
+	query.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	callback.RawQuery = query.Encode()
+	resp, err := h.client().Get(callback.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || strings.TrimSpace(string(body)) != challenge {
+		return errors.New("subscriber did not confirm the intent")
+	}
+	return nil
+}
+
+// Deliver sends the content of the topic to the subscriber, signing it when
+// the subscriber provided a secret. link is sent in the Link header.
+func (h *Hub) Deliver(sub Subscription, contentType, link, content string) error {
+	req, err := http.NewRequest("POST", sub.Callback, strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Link", link)
+	if sub.Secret != "" {
+		req.Header.Set("X-Hub-Signature", Signature(sub.Secret, content))
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("subscriber returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Signature returns the value of the X-Hub-Signature header for the content,
+// using HMAC-SHA256.
+func Signature(secret, content string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(content))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,284 @@
+// Copyright 2015 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryStore struct {
+	subs  map[string]Subscription
+	mutex sync.Mutex
+}
+
+func (s *memoryStore) Save(sub *Subscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.subs == nil {
+		s.subs = make(map[string]Subscription)
+	}
+	s.subs[sub.Callback+" "+sub.Topic] = *sub
+	return nil
+}
+
+func (s *memoryStore) Remove(sub *Subscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subs, sub.Callback+" "+sub.Topic)
+	return nil
+}
+
+func (s *memoryStore) get(callback, topic string) (Subscription, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sub, ok := s.subs[callback+" "+topic]
+	return sub, ok
+}
+
+// subscriberStub is a WebSub subscriber that answers the verification of
+// intent using the given function, recording the query strings received.
+type subscriberStub struct {
+	server  *httptest.Server
+	answer  func(challenge string) string
+	queries chan url.Values
+}
+
+func newSubscriberStub(answer func(challenge string) string) *subscriberStub {
+	stub := subscriberStub{answer: answer, queries: make(chan url.Values, 1)}
+	stub.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		stub.queries <- query
+		fmt.Fprint(w, stub.answer(query.Get("hub.challenge")))
+	}))
+	return &stub
+}
+
+const testTopic = "http://feeds.example.com/all.atom"
+
+// subscribe sends a subscription request to the hub, returning the result of
+// the verification.
+func subscribe(t *testing.T, store *memoryStore, callback string, params url.Values) (*httptest.ResponseRecorder, error) {
+	done := make(chan error, 1)
+	hub := Hub{
+		Store: store,
+		ValidTopic: func(r *http.Request, topic string) error {
+			if topic != testTopic {
+				return errors.New("invalid topic")
+			}
+			return nil
+		},
+		Verified: func(mode string, sub Subscription, err error) {
+			done <- err
+		},
+	}
+	form := url.Values{
+		"hub.mode":     []string{"subscribe"},
+		"hub.topic":    []string{testTopic},
+		"hub.callback": []string{callback},
+	}
+	for key, value := range params {
+		form[key] = value
+	}
+	req, err := http.NewRequest("POST", "/hub", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	hub.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusAccepted {
+		return recorder, nil
+	}
+	select {
+	case err = <-done:
+		return recorder, err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the verification of intent")
+	}
+	return recorder, nil
+}
+
+func TestHubSubscribeEchoesChallenge(t *testing.T) {
+	stub := newSubscriberStub(func(challenge string) string { return challenge })
+	defer stub.server.Close()
+	var store memoryStore
+	callback := stub.server.URL + "/callback?id=1"
+	_, err := subscribe(t, &store, callback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := <-stub.queries
+	if query.Get("hub.mode") != "subscribe" || query.Get("hub.topic") != testTopic || query.Get("id") != "1" {
+		t.Errorf("unexpected verification request: %v", query)
+	}
+	if lease := query.Get("hub.lease_seconds"); lease != strconv.Itoa(int(DefaultLease.Seconds())) {
+		t.Errorf("want default lease, got %q", lease)
+	}
+	sub, ok := store.get(callback, testTopic)
+	if !ok {
+		t.Fatal("subscription was not saved")
+	}
+	if expires := time.Now().Add(DefaultLease); sub.Expires.After(expires) || sub.Expires.Before(expires.Add(-time.Minute)) {
+		t.Errorf("want subscription expiring in %s, got %s", DefaultLease, sub.Expires)
+	}
+}
+
+func TestHubSubscribeRejectedChallenge(t *testing.T) {
+	stub := newSubscriberStub(func(challenge string) string { return "not the challenge" })
+	defer stub.server.Close()
+	var store memoryStore
+	_, err := subscribe(t, &store, stub.server.URL, nil)
+	if err == nil {
+		t.Error("want error for wrong challenge, got nil")
+	}
+	if _, ok := store.get(stub.server.URL, testTopic); ok {
+		t.Error("subscription with wrong challenge was saved")
+	}
+}
+
+func TestHubSubscribeCapsLease(t *testing.T) {
+	stub := newSubscriberStub(func(challenge string) string { return challenge })
+	defer stub.server.Close()
+	var store memoryStore
+	params := url.Values{"hub.lease_seconds": []string{strconv.Itoa(int(MaxLease.Seconds()) * 10)}}
+	if _, err := subscribe(t, &store, stub.server.URL, params); err != nil {
+		t.Fatal(err)
+	}
+	query := <-stub.queries
+	if lease := query.Get("hub.lease_seconds"); lease != strconv.Itoa(int(MaxLease.Seconds())) {
+		t.Errorf("want lease capped at %s, got %q", MaxLease, lease)
+	}
+	sub, _ := store.get(stub.server.URL, testTopic)
+	if sub.Expires.After(time.Now().Add(MaxLease)) {
+		t.Errorf("want subscription expiring in at most %s, got %s", MaxLease, sub.Expires)
+	}
+}
+
+func TestHubSubscribeInvalidTopic(t *testing.T) {
+	var store memoryStore
+	params := url.Values{"hub.topic": []string{"http://evil.example.com/all.atom"}}
+	recorder, _ := subscribe(t, &store, "http://subscriber.example.com/", params)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("want status %d, got %d", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestParseLease(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{"", DefaultLease, false},
+		{"3600", time.Hour, false},
+		{"99999999999", MaxLease, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLease(tt.value)
+		if (err != nil) != tt.err || got != tt.expected {
+			t.Errorf("ParseLease(%q): want %s (error: %v), got %s (%v)", tt.value, tt.expected, tt.err, got, err)
+		}
+	}
+}
+
+func TestHubDeliverSignature(t *testing.T) {
+	content := `<feed xmlns="http://www.w3.org/2005/Atom"></feed>`
+	received := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+	var hub Hub
+	sub := Subscription{Callback: server.URL, Topic: testTopic, Secret: "s3cr3t"}
+	err := hub.Deliver(sub, "application/atom+xml", "<http://feeds.example.com/hub>; rel=\"hub\"", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-received
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-Hub-Signature"); got != expected {
+		t.Errorf("want X-Hub-Signature %q, got %q", expected, got)
+	}
+	if string(body) != content {
+		t.Errorf("want body %q, got %q", content, body)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/atom+xml" {
+		t.Errorf("want Content-Type %q, got %q", "application/atom+xml", ct)
+	}
+}
+
+func TestHubDeliverWithoutSecret(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer server.Close()
+	var hub Hub
+	if err := hub.Deliver(Subscription{Callback: server.URL}, "application/atom+xml", "", "content"); err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-received).Header.Get("X-Hub-Signature"); got != "" {
+		t.Errorf("want no X-Hub-Signature, got %q", got)
+	}
+}
+
+func TestHubPublishRequiresSecret(t *testing.T) {
+	var tests = []struct {
+		hubSecret string
+		header    string
+		expected  int
+	}{
+		{"s3cr3t", "", http.StatusForbidden},
+		{"s3cr3t", "wrong", http.StatusForbidden},
+		{"", "", http.StatusForbidden},
+		{"s3cr3t", "s3cr3t", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		published := make(chan bool, 1)
+		hub := Hub{PublishSecret: tt.hubSecret, Publish: func() { published <- true }}
+		req, err := http.NewRequest("POST", "/hub", strings.NewReader("hub.mode=publish"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.header != "" {
+			req.Header.Set("X-Hub-Publish-Secret", tt.header)
+		}
+		recorder := httptest.NewRecorder()
+		hub.ServeHTTP(recorder, req)
+		if recorder.Code != tt.expected {
+			t.Errorf("secret %q, header %q: want status %d, got %d", tt.hubSecret, tt.header, tt.expected, recorder.Code)
+		}
+		if tt.expected == http.StatusNoContent {
+			select {
+			case <-published:
+			case <-time.After(5 * time.Second):
+				t.Error("Publish was not called")
+			}
+		} else if len(published) > 0 {
+			t.Errorf("secret %q, header %q: Publish was called", tt.hubSecret, tt.header)
+		}
+	}
+}
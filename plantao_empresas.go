@@ -3,151 +3,1321 @@
 // license that can be found in the LICENSE file.
 
 // This bot collects information from "Plantão Empresas", at Bovespa, scrapping
-// the HTML.
+// the HTML. Besides the title and date of each news, it also downloads and
+// stores the body of the news. Failed downloads are retried in later runs,
+// with exponential backoff, until maxBodyAttempts, or never, when the page of
+// the body doesn't exist.
+//
+// Titles are parsed into the name of the issuer, the tickers mentioned in the
+// title and a category (see lib.ParsePlantaoTitle).
+//
+// Each run scrapes the listing page by page, stopping at the first page that
+// contains only news that are already stored (unless -full is provided), or
+// after -max-pages pages. Failed requests are retried with exponential
+// backoff. When a run doesn't reach a page of stored news, because of an
+// error or of -max-pages, the oldest news it found is recorded in the
+// "backfills" collection, and the next runs of the job don't stop before
+// reaching a page of stored news older than that.
+//
+// Each news stored for the first time is emitted as an event, in the "events"
+// capped collection, so other services can tail it instead of polling the
+// news collection. Events are also posted, in JSON format, to the URL provided
+// in the -webhook flag. A summary of each run, including the number of new
+// news, is stored in the "runs" collection.
+//
+// News that were already stored are compared to the listing: changes in the
+// title or in the date, as well as news that disappear from the listing (and
+// reappear later), are recorded in the "revisions" collection, keeping the
+// history of each news. The news itself always holds the latest version,
+// along with the time of the latest revision.
+//
+// When new news are found, the bot also notifies the WebSub hub provided in
+// the -hub flag (see feed_plantao_empresas.go).
+//
+// A single process may run several jobs, each one with its own filter, search
+// term and interval, defined by the -job flag, which may be repeated:
+//
+//	plantao_empresas -job name=daily,filter=0,interval=5m -job name=weekly,filter=1,interval=1h
+//
+// Every job runs once on startup. Instead of a fixed interval, a job may
+// define a cron-style schedule (minute, hour, day of month, month and day of
+// week), evaluated in the time zone given by tz (America/Sao_Paulo by
+// default). With tradingdays=true, the job only runs on days in which B3 is
+// open. For example, for running every 5 minutes from 08:00 to 19:55 on
+// trading days:
+//
+//	plantao_empresas -job "name=daily,schedule=*/5 8-19 * * 1-5,tradingdays=true"
+//
+// Jobs share the same MongoDB session and never run concurrently. When -http
+// is provided, the status of each job is served in JSON format.
+//
+// The archive of news can be exported to and imported from CSV and JSON Lines
+// files, using the export and import commands, instead of running the jobs:
+//
+//	plantao_empresas export -from 2015-01-01 -to 2015-06-30 -category dividend -format csv -o dividends.csv
+//	plantao_empresas export -title '^fii' > fii.jsonl
+//	plantao_empresas import -i fii.jsonl
+//
+// Importing never downloads anything, and existing news are updated with the
+// data in the file.
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/tsuru/tsuru/db/storage"
+	"github.com/fsouza/inv_bots/lib"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"launchpad.net/xmlpath"
 )
 
-const BaseURL = "http://www.bmfbovespa.com.br/Agencia-Noticias/ListarNoticias.aspx?idioma=pt-br&q=&tipoFiltro=%d&pg=%d"
+const (
+	BaseURL = "http://www.bmfbovespa.com.br/Agencia-Noticias/ListarNoticias.aspx?idioma=pt-br&q=%s&tipoFiltro=%d&pg=%d"
+	BodyURL = "http://www.bmfbovespa.com.br/agencia/corpo.asp?origem=exibir&id=%s"
+
+	// maxBodies is the maximum number of bodies of old news downloaded in
+	// each run, for news that were saved without the body.
+	maxBodies = 20
+
+	// maxBodyAttempts is the number of failed downloads of the body of a news
+	// before giving up on it. Failed downloads are retried after an hour,
+	// doubling the wait on each attempt.
+	maxBodyAttempts = 5
+
+	// eventsSize is the maximum size, in bytes, of the capped collection of
+	// events.
+	eventsSize = 16 << 20
+)
 
 var (
-	pathLink              = xmlpath.MustCompile(`//ul[@id="linksNoticias"]/li/a`)
-	pathHrefLink          = xmlpath.MustCompile("./@href")
-	idRegexp              = regexp.MustCompile(`^ListarNoticias.aspx\?idioma=pt-br\&idNoticia=(\d+)\&.*$`)
-	replaceLessThan       = []byte{' ', '<', ' '}
-	replaceGreaterThan    = []byte{' ', '>', ' '}
-	replaceLessOrEqual    = []byte{' ', '<', '=', ' '}
-	replaceGreaterOrEqual = []byte{' ', '>', '=', ' '}
-	tickerTimer           time.Duration
-	filter                int
+	pathBody = xmlpath.MustCompile("//body")
+	fetcher  = lib.NewFetcher()
+	// httpClient is used for notifications sent while a job holds runMutex,
+	// so a slow receiver can't block the other jobs.
+	httpClient  = &http.Client{Timeout: 10 * time.Second}
+	session     *mgo.Session
+	runMutex    sync.Mutex
+	jobs        jobList
+	mongoURI    string
+	listenHTTP  string
+	tickerTimer time.Duration
+	filter      int
+	hubURL      string
+	hubSecret   string
+	webhookURL  string
+	maxPages    int
+	fullScrape  bool
+	cronSpec    string
+	tradingDays bool
 )
 
 func init() {
-	flag.DurationVar(&tickerTimer, "interval", 10*time.Minute, "Ticker interval")
-	flag.IntVar(&filter, "filter", 0, "News filter (0 for daily, 1 for weekly)")
+	flag.DurationVar(&tickerTimer, "interval", 10*time.Minute, "Ticker interval, used when no job is provided")
+	flag.IntVar(&filter, "filter", 0, "News filter (0 for daily, 1 for weekly), used when no job is provided")
+	flag.StringVar(&cronSpec, "schedule", "", "Cron-style schedule, in the America/Sao_Paulo time zone, used instead of -interval when no job is provided")
+	flag.BoolVar(&tradingDays, "trading-days", false, "Run only on trading days, used along with -schedule when no job is provided")
+	flag.Var(&jobs, "job", "Job definition, in the format name=<name>,filter=<filter>,interval=<interval>,q=<query>,schedule=<schedule>,tz=<timezone>,tradingdays=<bool> (may be repeated)")
+	flag.StringVar(&mongoURI, "mongodb", "localhost:27017/bovespa_plantao_empresas", "MongoDB connection string, including the database")
+	flag.StringVar(&listenHTTP, "http", "", "Address for serving the status of the jobs (disabled when empty)")
+	flag.StringVar(&hubURL, "hub", "", "URL of the WebSub hub notified when there are new news")
+	flag.StringVar(&hubSecret, "hub-secret", "", "Secret for publishing to the WebSub hub")
+	flag.StringVar(&webhookURL, "webhook", "", "URL that receives new news, in JSON format")
+	flag.IntVar(&maxPages, "max-pages", 20, "Maximum number of pages scraped in each run")
+	flag.BoolVar(&fullScrape, "full", false, "Scrape all pages, even those containing only stored news")
+	flag.IntVar(&fetcher.Retries, "retries", fetcher.Retries, "Number of retries for each page")
+	flag.DurationVar(&fetcher.Backoff, "backoff", fetcher.Backoff, "Time to wait before the first retry, doubled on each retry")
 	flag.Parse()
 }
 
 type News struct {
-	ID    string `bson:"_id"`
-	Title string
-	Date  time.Time
+	ID       string `bson:"_id"`
+	Title    string
+	Date     time.Time
+	Body     string `bson:",omitempty"`
+	Issuer   string
+	Tickers  []string
+	Category string
+	Removed  bool      `bson:",omitempty"`
+	Revised  time.Time `bson:",omitempty"`
+
+	// Modified is the time of the latest change in the news, used by the
+	// feeds for detecting changes in older news.
+	Modified time.Time `bson:",omitempty"`
+
+	// Failed downloads of the body. BodyFailed means that the bot gave up on
+	// it, either after maxBodyAttempts or because the page doesn't exist.
+	BodyAttempts int       `bson:",omitempty"`
+	NextBody     time.Time `bson:",omitempty"`
+	BodyFailed   bool      `bson:",omitempty"`
+}
+
+// bodyDue returns whether the body of a stored news should be downloaded.
+func (n *News) bodyDue(now time.Time) bool {
+	return n.Body == "" && !n.BodyFailed && !n.NextBody.After(now)
 }
 
-func collection() (*storage.Collection, error) {
-	storage, err := storage.Open("localhost:27017", "bovespa_plantao_empresas")
+// bodyFailure returns the fields recording a failed download of the body of
+// the news.
+func bodyFailure(n *News, err error, now time.Time) bson.M {
+	attempts := n.BodyAttempts + 1
+	if e, ok := err.(*lib.StatusError); (ok && e.StatusCode < 500) || attempts >= maxBodyAttempts {
+		return bson.M{"bodyattempts": attempts, "bodyfailed": true}
+	}
+	return bson.M{"bodyattempts": attempts, "nextbody": now.Add(time.Hour << uint(attempts-1))}
+}
+
+// parseTitle fills the issuer, the tickers and the category of the news,
+// based on the title.
+func (n *News) parseTitle() {
+	parsed := lib.ParsePlantaoTitle(n.Title)
+	n.Issuer, n.Tickers, n.Category = parsed.Issuer, parsed.Tickers, parsed.Category
+}
+
+// Job is a configuration of the scraper, that runs in its own interval, or
+// according to its own schedule, when Schedule is not nil.
+type Job struct {
+	Name     string
+	Filter   int
+	Query    string
+	Interval time.Duration
+	Schedule *lib.Schedule
+	CronSpec string
+
+	status JobStatus
+	mutex  sync.Mutex
+}
+
+// JobStatus is the status of a job, after its last run.
+type JobStatus struct {
+	Name      string
+	Filter    int
+	Query     string
+	Interval  string `json:",omitempty"`
+	Schedule  string `json:",omitempty"`
+	Runs      int
+	LastRun   time.Time `json:",omitempty"`
+	NextRun   time.Time `json:",omitempty"`
+	Duration  string    `json:",omitempty"`
+	Pages     int
+	New       int
+	TotalNew  int
+	LastError string `json:",omitempty"`
+}
+
+func (j *Job) Status() JobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	status := j.status
+	status.Name = j.Name
+	status.Filter = j.Filter
+	status.Query = j.Query
+	if j.Schedule != nil {
+		status.Schedule = j.CronSpec
+	} else {
+		status.Interval = j.Interval.String()
+	}
+	return status
+}
+
+// next returns the time of the next run of the job, after t. It returns the
+// zero time if the schedule of the job never matches again.
+func (j *Job) next(t time.Time) time.Time {
+	if j.Schedule == nil {
+		return t.Add(j.Interval)
+	}
+	return j.Schedule.Next(t)
+}
+
+func (j *Job) setNextRun(t time.Time) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status.NextRun = t
+}
+
+func (j *Job) update(run *Run, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status.Runs++
+	j.status.LastRun = run.Date
+	j.status.Duration = run.Duration.String()
+	j.status.Pages = run.Pages
+	j.status.New = run.New
+	j.status.TotalNew += run.New
+	j.status.LastError = ""
 	if err != nil {
-		return nil, err
+		j.status.LastError = err.Error()
+	}
+}
+
+// jobList is a flag.Value for the list of jobs.
+type jobList []*Job
+
+func (l *jobList) String() string {
+	names := make([]string, len(*l))
+	for i, job := range *l {
+		names[i] = job.Name
 	}
-	coll := storage.Collection("news")
-	coll.EnsureIndex(mgo.Index{Key: []string{"title"}, Background: true, Sparse: true})
-	coll.EnsureIndex(mgo.Index{Key: []string{"-date"}, Background: true, Sparse: true})
-	coll.EnsureIndex(mgo.Index{Key: []string{"title", "-date"}, Background: true, Sparse: true})
-	return coll, nil
+	return strings.Join(names, ",")
 }
 
-func downloadContent(page int) (*xmlpath.Node, error) {
-	url := fmt.Sprintf(BaseURL, filter, page)
-	resp, err := http.Get(url)
+func (l *jobList) Set(value string) error {
+	job := Job{Interval: 10 * time.Minute}
+	var (
+		timezone = "America/Sao_Paulo"
+		trading  bool
+	)
+	for _, param := range splitParams(value) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid job parameter: %q", param)
+		}
+		var err error
+		switch parts[0] {
+		case "name":
+			job.Name = parts[1]
+		case "filter":
+			job.Filter, err = strconv.Atoi(parts[1])
+		case "interval":
+			job.Interval, err = time.ParseDuration(parts[1])
+		case "q":
+			job.Query = parts[1]
+		case "schedule":
+			job.CronSpec = parts[1]
+		case "tz":
+			timezone = parts[1]
+		case "tradingdays":
+			trading, err = strconv.ParseBool(parts[1])
+		default:
+			err = fmt.Errorf("unknown job parameter: %q", parts[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if job.Interval <= 0 {
+		return errors.New("the interval of the job must be positive")
+	}
+	if job.CronSpec != "" {
+		var err error
+		job.Schedule, err = parseSchedule(job.CronSpec, timezone, trading)
+		if err != nil {
+			return err
+		}
+	} else if trading {
+		return errors.New("tradingdays requires a schedule")
+	}
+	if job.Name == "" {
+		job.Name = fmt.Sprintf("filter-%d", job.Filter)
+		if job.Query != "" {
+			job.Name += "-" + job.Query
+		}
+	}
+	for _, j := range *l {
+		if j.Name == job.Name {
+			return fmt.Errorf("duplicate job: %q", job.Name)
+		}
+	}
+	*l = append(*l, &job)
+	return nil
+}
+
+// splitParams splits the parameters of a job, separated by commas. As commas
+// are also used in schedules ("0,30 * * * *"), a segment that doesn't look
+// like a parameter is appended to the previous one.
+func splitParams(value string) []string {
+	var params []string
+	for _, segment := range strings.Split(value, ",") {
+		if len(params) > 0 && !strings.Contains(segment, "=") {
+			params[len(params)-1] += "," + segment
+			continue
+		}
+		params = append(params, segment)
+	}
+	return params
+}
+
+func parseSchedule(spec, timezone string, tradingDays bool) (*lib.Schedule, error) {
+	location, err := time.LoadLocation(timezone)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	content, err := ioutil.ReadAll(resp.Body)
+	schedule, err := lib.ParseSchedule(spec, location)
 	if err != nil {
 		return nil, err
 	}
-	content = bytes.Replace(content, replaceLessThan, nil, -1)
-	content = bytes.Replace(content, replaceGreaterThan, nil, -1)
-	content = bytes.Replace(content, replaceLessOrEqual, nil, -1)
-	content = bytes.Replace(content, replaceGreaterOrEqual, nil, -1)
-	node, err := xmlpath.ParseHTML(bytes.NewBuffer(content))
+	schedule.TradingDays = tradingDays
+	return schedule, nil
+}
+
+const (
+	RevisionEdited   = "edited"
+	RevisionRemoved  = "removed"
+	RevisionRestored = "restored"
+)
+
+// Revision records a change in a news that was already stored. Title and
+// Date are the values after the change, and the previous values are only
+// filled for edits.
+type Revision struct {
+	NewsID        string
+	Kind          string
+	Title         string
+	Date          time.Time
+	PreviousTitle string    `bson:",omitempty"`
+	PreviousDate  time.Time `bson:",omitempty"`
+	Found         time.Time
+}
+
+// revise compares the stored version of the news with the version found in
+// the listing, returning the revisions between them.
+func revise(stored, found News, now time.Time) []Revision {
+	var revisions []Revision
+	if stored.Removed {
+		revisions = append(revisions, Revision{NewsID: found.ID, Kind: RevisionRestored, Title: found.Title, Date: found.Date, Found: now})
+	}
+	if (stored.Title != found.Title && stored.Title != unescapedTitle(found.Title)) || !stored.Date.Equal(found.Date) {
+		revisions = append(revisions, Revision{
+			NewsID:        found.ID,
+			Kind:          RevisionEdited,
+			Title:         found.Title,
+			Date:          found.Date,
+			PreviousTitle: stored.Title,
+			PreviousDate:  stored.Date,
+			Found:         now,
+		})
+	}
+	return revisions
+}
+
+// unescapedTitle returns the title as it was stored before the comparison
+// operators in the listing were escaped, when they were removed from the
+// titles. Titles stored that way are updated without recording a revision.
+func unescapedTitle(title string) string {
+	for _, op := range []string{" < ", " > ", " <= ", " >= "} {
+		title = strings.Replace(title, op, "", -1)
+	}
+	return title
+}
+
+// Event is emitted when a news is stored for the first time.
+type Event struct {
+	NewsID string
+	Title  string
+	Date   time.Time
+	Found  time.Time
+}
+
+// Run contains information about each run of the bot.
+type Run struct {
+	Date     time.Time
+	Duration time.Duration
+	Pages    int
+	Requests int64
+	New      int
+	Revised  int
+	Job      string
+	Filter   int
+	Query    string `bson:",omitempty"`
+	Error    string `bson:",omitempty"`
+}
+
+// connect opens the session shared by all jobs, creating the indexes and the
+// capped collection of events.
+func connect() error {
+	var err error
+	session, err = mgo.DialWithTimeout(mongoURI, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	err = session.DB("").C("revisions").EnsureIndex(mgo.Index{Key: []string{"newsid", "-found"}, Background: true})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	coll := session.DB("").C("news")
+	indexes := []mgo.Index{
+		{Key: []string{"title"}, Background: true, Sparse: true},
+		{Key: []string{"-date"}, Background: true, Sparse: true},
+		{Key: []string{"title", "-date"}, Background: true, Sparse: true},
+		{Key: []string{"category", "-date"}, Background: true, Sparse: true},
+		{Key: []string{"tickers", "-date"}, Background: true, Sparse: true},
+		{Key: []string{"-revised"}, Background: true, Sparse: true},
+		{Key: []string{"-modified"}, Background: true, Sparse: true},
 	}
-	return node, err
+	for _, index := range indexes {
+		if err = coll.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+	return createEvents()
 }
 
-func saveNews(news []News) {
-	coll, err := collection()
+// openCollection returns the given collection in a copy of the main session.
+// The caller is responsible for closing the session.
+func openCollection(name string) *mgo.Collection {
+	return session.Copy().DB("").C(name)
+}
+
+// createEvents creates the capped collection of events, if it doesn't exist.
+func createEvents() error {
+	coll := openCollection("events")
+	defer coll.Database.Session.Close()
+	names, err := coll.Database.CollectionNames()
 	if err != nil {
-		log.Printf("[ERROR] Failed to save news: %s", err)
+		return err
+	}
+	for _, name := range names {
+		if name == "events" {
+			return nil
+		}
+	}
+	return coll.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: eventsSize})
+}
+
+func collection() *mgo.Collection {
+	return openCollection("news")
+}
+
+// categorizeStored parses the title of news stored before the bot started
+// categorizing news.
+func categorizeStored() error {
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var news News
+	iter := coll.Find(bson.M{"category": bson.M{"$exists": false}}).Select(bson.M{"title": 1}).Iter()
+	for iter.Next(&news) {
+		news.parseTitle()
+		err := coll.UpdateId(news.ID, bson.M{"$set": bson.M{
+			"issuer":   news.Issuer,
+			"tickers":  news.Tickers,
+			"category": news.Category,
+			"modified": time.Now(),
+		}})
+		if err != nil {
+			log.Printf("[ERROR] Failed to categorize news %s: %s", news.ID, err)
+		}
+	}
+	return iter.Close()
+}
+
+// newsScraper scrapes the pages of the listing of news, saving the news found
+// in each page.
+type newsScraper struct {
+	job      *Job
+	seen     []string
+	newest   time.Time
+	oldest   time.Time
+	revised  int
+	pages    int
+	inserted []News
+
+	// backfill is the oldest news found by an incomplete run of the job, if
+	// any. Pages of stored news newer than it don't stop the scraper.
+	backfill time.Time
+
+	// caughtUp indicates that the scraper reached the end of the listing or
+	// a page of stored news older than backfill.
+	caughtUp bool
+}
+
+func (s *newsScraper) URL(page int) string {
+	return fmt.Sprintf(BaseURL, url.QueryEscape(s.job.Query), s.job.Filter, page)
+}
+
+func (s *newsScraper) Sanitizers() []lib.Sanitizer {
+	return lib.PlantaoSanitizers
+}
+
+func (s *newsScraper) Scrape(page int, node *xmlpath.Node) (bool, error) {
+	s.pages = page
+	items, ok := lib.ParsePlantao(node)
+	if !ok {
+		s.caughtUp = true
+		return false, nil
+	}
+	newsList := collectNews(items)
+	if len(newsList) == 0 {
+		return page < maxPages, nil
+	}
+	var pageOldest time.Time
+	for _, news := range newsList {
+		if pageOldest.IsZero() || news.Date.Before(pageOldest) {
+			pageOldest = news.Date
+		}
+		s.seen = append(s.seen, news.ID)
+		if s.newest.IsZero() || news.Date.After(s.newest) {
+			s.newest = news.Date
+		}
+		if s.oldest.IsZero() || news.Date.Before(s.oldest) {
+			s.oldest = news.Date
+		}
+	}
+	inserted, revised := saveNews(newsList)
+	s.inserted = append(s.inserted, inserted...)
+	s.revised += revised
+	if len(inserted) == 0 && (s.backfill.IsZero() || pageOldest.Before(s.backfill)) {
+		s.caughtUp = true
+		if !fullScrape {
+			return false, nil
+		}
+	}
+	return page < maxPages, nil
+}
+
+// Backfill is the oldest news found by an incomplete run of a job.
+type Backfill struct {
+	Job    string `bson:"_id"`
+	Oldest time.Time
+}
+
+func loadBackfill(job *Job) time.Time {
+	coll := openCollection("backfills")
+	defer coll.Database.Session.Close()
+	var backfill Backfill
+	err := coll.FindId(job.Name).One(&backfill)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Printf("[ERROR] [%s] Failed to load backfill: %s", job.Name, err)
+	}
+	return backfill.Oldest
+}
+
+// saveBackfill records whether the run left news behind: the backfill is
+// removed once the scraper catches up, and otherwise moved to the oldest news
+// found either in this run or in previous incomplete runs.
+func saveBackfill(s *newsScraper, err error) {
+	coll := openCollection("backfills")
+	defer coll.Database.Session.Close()
+	if err == nil && s.caughtUp {
+		if !s.backfill.IsZero() {
+			if err := coll.RemoveId(s.job.Name); err != nil && err != mgo.ErrNotFound {
+				log.Printf("[ERROR] [%s] Failed to remove backfill: %s", s.job.Name, err)
+			}
+		}
 		return
 	}
-	defer coll.Close()
+	oldest := s.oldest
+	if !s.backfill.IsZero() && (oldest.IsZero() || s.backfill.Before(oldest)) {
+		oldest = s.backfill
+	}
+	if oldest.IsZero() {
+		return
+	}
+	log.Printf("[WARNING] [%s] Run didn't reach stored news, the next runs will scrape past %s", s.job.Name, oldest)
+	if _, err := coll.UpsertId(s.job.Name, bson.M{"$set": bson.M{"oldest": oldest}}); err != nil {
+		log.Printf("[ERROR] [%s] Failed to save backfill: %s", s.job.Name, err)
+	}
+}
+
+func downloadBody(id string) (string, error) {
+	url := fmt.Sprintf(BodyURL, id)
+	content, err := fetcher.Fetch(url)
+	if err != nil {
+		return "", err
+	}
+	node, err := lib.ParseHTML(content)
+	if err != nil {
+		return "", err
+	}
+	body, ok := pathBody.String(node)
+	if !ok {
+		return "", fmt.Errorf("body not found in %s", url)
+	}
+	return strings.TrimSpace(body), nil
+}
+
+// saveNews saves the given news, returning the news that were not stored
+// before and the number of news that were revised.
+func saveNews(news []News) ([]News, int) {
+	var (
+		inserted  []News
+		revisions []Revision
+		revised   int
+	)
+	now := time.Now()
+	coll := collection()
+	defer coll.Database.Session.Close()
 	for _, n := range news {
-		_, err = coll.UpsertId(n.ID, n)
+		var stored News
+		err := coll.FindId(n.ID).Select(bson.M{"title": 1, "date": 1, "body": 1, "removed": 1, "issuer": 1, "tickers": 1, "category": 1, "bodyattempts": 1, "nextbody": 1, "bodyfailed": 1}).One(&stored)
+		if err != nil && err != mgo.ErrNotFound {
+			log.Printf("[ERROR] Failed to load news %s: %s", n.ID, err)
+			continue
+		}
+		fields := bson.M{
+			"title":    n.Title,
+			"date":     n.Date,
+			"issuer":   n.Issuer,
+			"tickers":  n.Tickers,
+			"category": n.Category,
+		}
+		update := bson.M{"$set": fields}
+		modified := err == mgo.ErrNotFound
+		var newsRevisions []Revision
+		if err == nil {
+			newsRevisions = revise(stored, n, now)
+			if len(newsRevisions) > 0 {
+				fields["revised"] = now
+			}
+			if stored.Removed {
+				update["$unset"] = bson.M{"removed": 1}
+			}
+			modified = len(newsRevisions) > 0 || stored.Title != n.Title || stored.Issuer != n.Issuer || stored.Category != n.Category ||
+				strings.Join(stored.Tickers, " ") != strings.Join(n.Tickers, " ")
+		}
+		if stored.bodyDue(now) {
+			body, err := downloadBody(n.ID)
+			if err != nil {
+				log.Printf("[WARNING] Failed to download body of news %s: %s", n.ID, err)
+				for key, value := range bodyFailure(&stored, err, now) {
+					fields[key] = value
+				}
+			} else {
+				fields["body"] = body
+				modified = true
+			}
+		}
+		if modified {
+			fields["modified"] = now
+		}
+		info, err := coll.UpsertId(n.ID, update)
 		if err != nil {
 			log.Printf("[ERROR] Failed to save news: %s", err)
+			continue
+		}
+		if info.UpsertedId != nil {
+			inserted = append(inserted, n)
+		}
+		if len(newsRevisions) > 0 {
+			revisions = append(revisions, newsRevisions...)
+			revised++
 		}
 	}
+	saveRevisions(revisions)
+	return inserted, revised
 }
 
-func collectNews(node *xmlpath.Node) []News {
-	location, _ := time.LoadLocation("America/Sao_Paulo")
-	var err error
-	var newsList []News
-	iter := pathLink.Iter(node)
-	for iter.Next() {
-		var news News
-		target, ok := pathHrefLink.String(iter.Node())
-		if !ok {
+// saveRevisions stores the given revisions in the revisions collection.
+func saveRevisions(revisions []Revision) {
+	if len(revisions) == 0 {
+		return
+	}
+	docs := make([]interface{}, len(revisions))
+	for i := range revisions {
+		docs[i] = revisions[i]
+	}
+	coll := openCollection("revisions")
+	defer coll.Database.Session.Close()
+	if err := coll.Insert(docs...); err != nil {
+		log.Printf("[ERROR] Failed to save revisions: %s", err)
+	}
+}
+
+// markRemoved marks as removed the stored news that should have been in the
+// pages scraped, but weren't. Only news strictly newer than the oldest news
+// in the pages are considered, as news published at the same time may be in
+// the next page. Listings filtered by a search term are ignored, as they don't
+// contain all news.
+func markRemoved(s *newsScraper) int {
+	if s.job.Query != "" || len(s.seen) == 0 {
+		return 0
+	}
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var missing []News
+	err := coll.Find(bson.M{
+		"_id":     bson.M{"$nin": s.seen},
+		"date":    bson.M{"$gt": s.oldest, "$lte": s.newest},
+		"removed": bson.M{"$ne": true},
+	}).Select(bson.M{"title": 1, "date": 1}).All(&missing)
+	if err != nil {
+		log.Printf("[ERROR] Failed to look for removed news: %s", err)
+		return 0
+	}
+	now := time.Now()
+	var revisions []Revision
+	for _, news := range missing {
+		err := coll.UpdateId(news.ID, bson.M{"$set": bson.M{"removed": true, "revised": now, "modified": now}})
+		if err != nil {
+			log.Printf("[ERROR] Failed to mark news %s as removed: %s", news.ID, err)
 			continue
 		}
-		parts := idRegexp.FindStringSubmatch(target)
-		if len(parts) > 1 {
-			news.ID = parts[1]
+		revisions = append(revisions, Revision{NewsID: news.ID, Kind: RevisionRemoved, Title: news.Title, Date: news.Date, Found: now})
+	}
+	saveRevisions(revisions)
+	return len(revisions)
+}
+
+// emitEvents inserts one event for each new news in the events collection,
+// posting them to the webhook, if any.
+func emitEvents(newsList []News) {
+	now := time.Now()
+	events := make([]interface{}, len(newsList))
+	for i, news := range newsList {
+		events[i] = Event{NewsID: news.ID, Title: news.Title, Date: news.Date, Found: now}
+	}
+	coll := openCollection("events")
+	defer coll.Database.Session.Close()
+	if err := coll.Insert(events...); err != nil {
+		log.Printf("[ERROR] Failed to emit events: %s", err)
+	}
+	if webhookURL != "" {
+		if err := postWebhook(events); err != nil {
+			log.Printf("[ERROR] Failed to post events to the webhook: %s", err)
 		}
-		content := iter.Node().String()
-		content = strings.TrimSpace(content)
-		parts = strings.SplitN(content, " - ", 2)
-		if len(parts) < 2 {
+	}
+}
+
+func postWebhook(events []interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{"events": events})
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status from the webhook: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func saveRun(run *Run) {
+	coll := openCollection("runs")
+	defer coll.Database.Session.Close()
+	if err := coll.Insert(run); err != nil {
+		log.Printf("[ERROR] Failed to save run: %s", err)
+	}
+}
+
+// notifyHub tells the WebSub hub that there are new news, so it can push the
+// feeds to the subscribers.
+func notifyHub() error {
+	form := url.Values{"hub.mode": []string{"publish"}}
+	req, err := http.NewRequest("POST", hubURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Hub-Publish-Secret", hubSecret)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status from the hub: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// saveMissingBodies downloads the body of news that were saved without it,
+// most likely because of a failure in a previous run. News whose download
+// failed are skipped until their next attempt, so older news are also
+// reached.
+func saveMissingBodies() {
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var newsList []News
+	now := time.Now()
+	query := bson.M{
+		"body":       bson.M{"$exists": false},
+		"bodyfailed": bson.M{"$ne": true},
+		"$or": []bson.M{
+			{"nextbody": bson.M{"$exists": false}},
+			{"nextbody": bson.M{"$lte": now}},
+		},
+	}
+	err := coll.Find(query).Sort("-date").Limit(maxBodies).All(&newsList)
+	if err != nil {
+		log.Printf("[ERROR] Failed to save bodies: %s", err)
+		return
+	}
+	for _, news := range newsList {
+		body, err := downloadBody(news.ID)
+		if err != nil {
+			log.Printf("[WARNING] Failed to download body of news %s: %s", news.ID, err)
+			if err := coll.UpdateId(news.ID, bson.M{"$set": bodyFailure(&news, err, now)}); err != nil {
+				log.Printf("[ERROR] Failed to record failure of news %s: %s", news.ID, err)
+			}
 			continue
 		}
-		news.Title = parts[1]
-		news.Date, err = time.ParseInLocation("02/01/2006 15:04", parts[0], location)
+		err = coll.UpdateId(news.ID, bson.M{"$set": bson.M{"body": body, "modified": time.Now()}})
 		if err != nil {
-			log.Printf("[WARNING] Wrong date for news: %s", err)
-			continue
+			log.Printf("[ERROR] Failed to save body of news %s: %s", news.ID, err)
 		}
-		newsList = append(newsList, news)
+	}
+}
+
+func collectNews(items []lib.PlantaoItem) []News {
+	newsList := make([]News, len(items))
+	for i, item := range items {
+		newsList[i] = News{ID: item.ID, Title: item.Title, Date: item.Date}
+		newsList[i].parseTitle()
 	}
 	return newsList
 }
 
-func run() {
-	for i := 0; ; i++ {
-		node, err := downloadContent(i + 1)
+// run runs the job once. Runs are serialized, so the statistics of the
+// fetcher reflect a single job.
+func run(job *Job) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	scraper := newsScraper{job: job, backfill: loadBackfill(job)}
+	start := time.Now()
+	before := fetcher.Stats()
+	err := fetcher.Scrape(&scraper)
+	saveBackfill(&scraper, err)
+	if err != nil {
+		log.Printf("[ERROR] [%s] Failed to collect news: %s", job.Name, err)
+	} else {
+		scraper.revised += markRemoved(&scraper)
+	}
+	after := fetcher.Stats()
+	log.Printf("[INFO] [%s] Scraped %d page(s) in %s, with %d request(s) and %d retry(ies). %d new news, %d revised.",
+		job.Name, scraper.pages, time.Since(start), after.Requests-before.Requests, after.Retries-before.Retries, len(scraper.inserted), scraper.revised)
+	r := Run{
+		Date:     start,
+		Duration: time.Since(start),
+		Pages:    scraper.pages,
+		Requests: after.Requests - before.Requests,
+		New:      len(scraper.inserted),
+		Revised:  scraper.revised,
+		Job:      job.Name,
+		Filter:   job.Filter,
+		Query:    job.Query,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	saveRun(&r)
+	job.update(&r, err)
+	if len(scraper.inserted) > 0 {
+		emitEvents(scraper.inserted)
+	}
+	saveMissingBodies()
+	if len(scraper.inserted)+scraper.revised > 0 && hubURL != "" {
+		if err := notifyHub(); err != nil {
+			log.Printf("[ERROR] Failed to notify the hub: %s", err)
+		}
+	}
+}
+
+// schedule runs the job right away and then keeps running it, according to
+// its interval or schedule.
+func schedule(job *Job) {
+	run(job)
+	if job.Schedule == nil {
+		job.setNextRun(job.next(time.Now()))
+		for _ = range time.Tick(job.Interval) {
+			run(job)
+			job.setNextRun(job.next(time.Now()))
+		}
+		return
+	}
+	for {
+		next := job.next(time.Now())
+		if next.IsZero() {
+			log.Printf("[ERROR] Job %s: schedule %q doesn't match any time, stopping", job.Name, job.CronSpec)
+			job.setNextRun(next)
+			return
+		}
+		job.setNextRun(next)
+		time.Sleep(next.Sub(time.Now()))
+		run(job)
+	}
+}
+
+func status(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]JobStatus, len(jobs))
+	for i, job := range jobs {
+		statuses[i] = job.Status()
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// archiveColumns are the columns of the CSV archive. Tickers are separated by
+// spaces and dates are in RFC 3339 format.
+var archiveColumns = []string{"id", "date", "title", "issuer", "tickers", "category", "removed", "revised", "body"}
+
+// ArchiveRecord is a news in the exported archive.
+type ArchiveRecord struct {
+	ID       string     `json:"id"`
+	Date     time.Time  `json:"date"`
+	Title    string     `json:"title"`
+	Issuer   string     `json:"issuer"`
+	Tickers  []string   `json:"tickers"`
+	Category string     `json:"category"`
+	Removed  bool       `json:"removed,omitempty"`
+	Revised  *time.Time `json:"revised,omitempty"`
+	Body     string     `json:"body,omitempty"`
+}
+
+func newArchiveRecord(news *News) ArchiveRecord {
+	record := ArchiveRecord{
+		ID:       news.ID,
+		Date:     news.Date,
+		Title:    news.Title,
+		Issuer:   news.Issuer,
+		Tickers:  news.Tickers,
+		Category: news.Category,
+		Removed:  news.Removed,
+		Body:     news.Body,
+	}
+	if !news.Revised.IsZero() {
+		revised := news.Revised
+		record.Revised = &revised
+	}
+	return record
+}
+
+func (r *ArchiveRecord) csv() []string {
+	var removed, revised string
+	if r.Removed {
+		removed = "true"
+	}
+	if r.Revised != nil {
+		revised = r.Revised.Format(time.RFC3339)
+	}
+	return []string{
+		r.ID,
+		r.Date.Format(time.RFC3339),
+		r.Title,
+		r.Issuer,
+		strings.Join(r.Tickers, " "),
+		r.Category,
+		removed,
+		revised,
+		r.Body,
+	}
+}
+
+func parseArchiveRow(row []string) (ArchiveRecord, error) {
+	var record ArchiveRecord
+	if len(row) != len(archiveColumns) {
+		return record, fmt.Errorf("expected %d columns, got %d", len(archiveColumns), len(row))
+	}
+	date, err := time.Parse(time.RFC3339, row[1])
+	if err != nil {
+		return record, err
+	}
+	record = ArchiveRecord{
+		ID:       row[0],
+		Date:     date,
+		Title:    row[2],
+		Issuer:   row[3],
+		Tickers:  strings.Fields(row[4]),
+		Category: row[5],
+		Body:     row[8],
+	}
+	if row[6] != "" {
+		if record.Removed, err = strconv.ParseBool(row[6]); err != nil {
+			return record, err
+		}
+	}
+	if row[7] != "" {
+		revised, err := time.Parse(time.RFC3339, row[7])
 		if err != nil {
-			log.Print(err)
-			continue
+			return record, err
+		}
+		record.Revised = &revised
+	}
+	return record, nil
+}
+
+// archiveFormat returns the format of the archive, using the extension of the
+// file when the format is not provided.
+func archiveFormat(format, filename string) (string, error) {
+	if format == "" {
+		format = "jsonl"
+		if strings.ToLower(filepath.Ext(filename)) == ".csv" {
+			format = "csv"
+		}
+	}
+	if format != "csv" && format != "jsonl" {
+		return "", fmt.Errorf("invalid format: %q (expected csv or jsonl)", format)
+	}
+	return format, nil
+}
+
+// archiveQuery builds the query used for exporting news. Dates are in the
+// format YYYY-MM-DD, in the America/Sao_Paulo time zone, and both are
+// inclusive.
+func archiveQuery(from, to, title, categories string) (bson.M, error) {
+	location, _ := time.LoadLocation("America/Sao_Paulo")
+	query := bson.M{}
+	date := bson.M{}
+	if from != "" {
+		t, err := time.ParseInLocation("2006-01-02", from, location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date: %q", from)
+		}
+		date["$gte"] = t
+	}
+	if to != "" {
+		t, err := time.ParseInLocation("2006-01-02", to, location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date: %q", to)
+		}
+		date["$lt"] = t.AddDate(0, 0, 1)
+	}
+	if len(date) > 0 {
+		query["date"] = date
+	}
+	if title != "" {
+		if _, err := regexp.Compile(title); err != nil {
+			return nil, err
+		}
+		query["title"] = bson.RegEx{Pattern: title, Options: "i"}
+	}
+	if categories != "" {
+		query["category"] = bson.M{"$in": strings.Split(categories, ",")}
+	}
+	return query, nil
+}
+
+// export writes the news matching the given flags to the output, in the
+// chosen format, from the oldest to the newest news.
+func export(args []string) error {
+	var from, to, title, categories, format, output string
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&from, "from", "", "Export news since the given date (YYYY-MM-DD)")
+	flags.StringVar(&to, "to", "", "Export news until the given date (YYYY-MM-DD), inclusive")
+	flags.StringVar(&title, "title", "", "Regular expression matched against the title (case insensitive)")
+	flags.StringVar(&categories, "category", "", "Comma-separated list of categories")
+	flags.StringVar(&format, "format", "", "Format of the archive: csv or jsonl (default: based on the output file, or jsonl)")
+	flags.StringVar(&output, "o", "", "Output file (default: standard output)")
+	flags.Parse(args)
+	format, err := archiveFormat(format, output)
+	if err != nil {
+		return err
+	}
+	query, err := archiveQuery(from, to, title, categories)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var (
+		news    News
+		count   int
+		csvW    *csv.Writer
+		encoder *json.Encoder
+	)
+	if format == "csv" {
+		csvW = csv.NewWriter(buf)
+		csvW.Write(archiveColumns)
+	} else {
+		encoder = json.NewEncoder(buf)
+	}
+	iter := coll.Find(query).Sort("date").Iter()
+	for iter.Next(&news) {
+		record := newArchiveRecord(&news)
+		if csvW != nil {
+			err = csvW.Write(record.csv())
+		} else {
+			err = encoder.Encode(record)
+		}
+		if err != nil {
+			iter.Close()
+			return err
 		}
-		if !pathLink.Exists(node) {
-			break
+		count++
+		news = News{}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	if csvW != nil {
+		csvW.Flush()
+		if err = csvW.Error(); err != nil {
+			return err
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	log.Printf("[INFO] Exported %d news.", count)
+	return nil
+}
+
+// readArchive reads the records in the archive, calling fn for each one of
+// them.
+func readArchive(r io.Reader, format string, fn func(ArchiveRecord) error) error {
+	if format == "csv" {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = len(archiveColumns)
+		for line := 1; ; line++ {
+			row, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if line == 1 && row[0] == archiveColumns[0] {
+				continue
+			}
+			record, err := parseArchiveRow(row)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			if err = fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var record ArchiveRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %s", line, err)
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// importArchive loads news from a file exported with export, updating news
+// that are already stored. An empty body never replaces a stored body.
+func importArchive(args []string) error {
+	var format, input string
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&format, "format", "", "Format of the archive: csv or jsonl (default: based on the input file, or jsonl)")
+	flags.StringVar(&input, "i", "", "Input file (default: standard input)")
+	flags.Parse(args)
+	format, err := archiveFormat(format, input)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if input != "" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	coll := collection()
+	defer coll.Database.Session.Close()
+	var inserted, updated int
+	err = readArchive(bufio.NewReader(r), format, func(record ArchiveRecord) error {
+		if record.ID == "" {
+			return errors.New("news without id")
+		}
+		fields := bson.M{
+			"title":    record.Title,
+			"date":     record.Date,
+			"issuer":   record.Issuer,
+			"tickers":  record.Tickers,
+			"category": record.Category,
+			"modified": time.Now(),
+		}
+		if record.Body != "" {
+			fields["body"] = record.Body
 		}
-		newsList := collectNews(node)
-		if len(newsList) > 0 {
-			saveNews(newsList)
+		if record.Removed {
+			fields["removed"] = true
 		}
+		if record.Revised != nil {
+			fields["revised"] = *record.Revised
+		}
+		info, err := coll.UpsertId(record.ID, bson.M{"$set": fields})
+		if err != nil {
+			return fmt.Errorf("failed to save news %s: %s", record.ID, err)
+		}
+		if info.UpsertedId != nil {
+			inserted++
+		} else {
+			updated++
+		}
+		return nil
+	})
+	log.Printf("[INFO] Imported %d new news, updated %d news.", inserted, updated)
+	return err
+}
+
+// command runs one of the commands (export or import) provided in the
+// command line.
+func command(args []string) error {
+	switch args[0] {
+	case "export":
+		return export(args[1:])
+	case "import":
+		return importArchive(args[1:])
 	}
+	return fmt.Errorf("unknown command: %q", args[0])
 }
 
 func main() {
-	for _ = range time.Tick(tickerTimer) {
-		run()
+	if flag.NArg() > 0 {
+		if err := connect(); err != nil {
+			log.Fatal(err)
+		}
+		defer session.Close()
+		if err := command(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(jobs) == 0 {
+		job := Job{Name: fmt.Sprintf("filter-%d", filter), Filter: filter, Interval: tickerTimer, CronSpec: cronSpec}
+		if cronSpec != "" {
+			var err error
+			job.Schedule, err = parseSchedule(cronSpec, "America/Sao_Paulo", tradingDays)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else if tradingDays {
+			log.Fatal("tradingdays requires a schedule")
+		}
+		jobs = jobList{&job}
+	}
+	if err := connect(); err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	if err := categorizeStored(); err != nil {
+		log.Printf("[ERROR] Failed to categorize stored news: %s", err)
+	}
+	for _, job := range jobs {
+		go schedule(job)
+	}
+	if listenHTTP != "" {
+		http.Handle("/", http.HandlerFunc(status))
+		log.Fatal(http.ListenAndServe(listenHTTP, nil))
 	}
+	select {}
 }
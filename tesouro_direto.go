@@ -12,7 +12,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"io/ioutil"
+	"github.com/fsouza/inv_bots/lib"
 	"launchpad.net/xmlpath"
 	"log"
 	"net/http"
@@ -38,6 +38,11 @@ var (
 	interval     time.Duration
 	pathTD       = xmlpath.MustCompile(`//table[@summary="Taxas"]/tbody/tr/td[1]`)
 	pathSiblings = xmlpath.MustCompile(`./following-sibling::*`)
+	sanitizers   = []lib.Sanitizer{
+		lib.Replace(" < ", " &lt; "),
+		lib.Replace(" > ", " &gt; "),
+	}
+	fetcher = lib.NewFetcher()
 )
 
 func init() {
@@ -45,26 +50,22 @@ func init() {
 	flag.StringVar(&listen, "http", ":7575", "Address to listen")
 }
 
-func collectTitulos() {
-	resp, err := http.Get(URL)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return
-	}
-	strBody := strings.Replace(string(body), " < ", " &lt; ", -1)
-	strBody = strings.Replace(strBody, " > ", " &gt; ", -1)
-	reader := strings.NewReader(strBody)
-	root, err := xmlpath.ParseHTML(reader)
-	if err != nil {
-		log.Printf("ERROR: %s", err)
-		return
-	}
-	titulos = make([]Titulo, 0, 10)
+// titulosScraper collects the list of bonds, which is available in a single
+// page.
+type titulosScraper struct {
+	titulos []Titulo
+}
+
+func (s *titulosScraper) URL(page int) string {
+	return URL
+}
+
+func (s *titulosScraper) Sanitizers() []lib.Sanitizer {
+	return sanitizers
+}
+
+func (s *titulosScraper) Scrape(page int, root *xmlpath.Node) (bool, error) {
+	s.titulos = make([]Titulo, 0, 10)
 	tds := pathTD.Iter(root)
 	for tds.Next() {
 		var titulo Titulo
@@ -110,8 +111,18 @@ func collectTitulos() {
 				titulo.PrecoVenda = precoVenda
 			}
 		}
-		titulos = append(titulos, titulo)
+		s.titulos = append(s.titulos, titulo)
+	}
+	return false, nil
+}
+
+func collectTitulos() {
+	var scraper titulosScraper
+	if err := fetcher.Scrape(&scraper); err != nil {
+		log.Printf("ERROR: %s", err)
+		return
 	}
+	titulos = scraper.titulos
 }
 
 func tesouroDireto(w http.ResponseWriter, r *http.Request) {